@@ -0,0 +1,316 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Timing statistics for benchmark runs
+//!
+//! Also holds the machine-readable form of a benchmark run and its comparison against a
+//! previously saved baseline, used to catch performance regressions in CI.
+
+use serde::{Deserialize, Serialize};
+use std::fmt::Write;
+use std::time::{Duration, Instant};
+
+/// Summary statistics over per-iteration timings, in milliseconds
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct TimingStats {
+    pub samples: usize,
+    pub mean_ms: f64,
+    pub min_ms: f64,
+    pub max_ms: f64,
+    pub p50_ms: f64,
+    pub p95_ms: f64,
+    pub p99_ms: f64,
+    pub stddev_ms: f64,
+}
+
+impl TimingStats {
+    /// Compute statistics from per-iteration samples; the input order is left untouched
+    pub fn from_samples(samples_ms: &[f64]) -> Option<Self> {
+        if samples_ms.is_empty() {
+            return None;
+        }
+
+        let mut sorted = samples_ms.to_vec();
+        sorted.sort_by(|a, b| a.total_cmp(b));
+
+        let n = sorted.len() as f64;
+        let mean_ms = sorted.iter().sum::<f64>() / n;
+        let variance = sorted.iter().map(|t| (t - mean_ms).powi(2)).sum::<f64>() / n;
+
+        Some(Self {
+            samples: sorted.len(),
+            mean_ms,
+            min_ms: sorted[0],
+            max_ms: sorted[sorted.len() - 1],
+            p50_ms: percentile(&sorted, 50.0),
+            p95_ms: percentile(&sorted, 95.0),
+            p99_ms: percentile(&sorted, 99.0),
+            stddev_ms: variance.sqrt(),
+        })
+    }
+}
+
+/// Nearest-rank percentile of an already sorted, non-empty slice
+fn percentile(sorted: &[f64], p: f64) -> f64 {
+    let rank = ((p / 100.0) * sorted.len() as f64).ceil() as usize;
+    sorted[rank.clamp(1, sorted.len()) - 1]
+}
+
+/// Shortest total time a throughput figure is taken from; quicker runs are dominated by
+/// the resolution of the clock
+pub const MIN_MEASURED_TIME: Duration = Duration::from_millis(1);
+
+/// Run `run` in batches of `batch` iterations until at least [`MIN_MEASURED_TIME`] has
+/// passed, so expressions quicker than the clock still get a meaningful throughput;
+/// returns the iterations run and their total time
+pub fn run_batched(batch: usize, mut run: impl FnMut()) -> (usize, Duration) {
+    let batch = batch.max(1);
+    let start = Instant::now();
+    let mut iterations = 0;
+    loop {
+        for _ in 0..batch {
+            run();
+        }
+        iterations += batch;
+        let elapsed = start.elapsed();
+        if elapsed >= MIN_MEASURED_TIME {
+            return (iterations, elapsed);
+        }
+    }
+}
+
+// Most evaluations timed together as one sample
+const MAX_BATCH: usize = 10_000;
+
+/// Number of runs to time together so one sample lasts at least [`MIN_MEASURED_TIME`],
+/// given the time of a single run
+pub fn batch_size(per_run: Duration) -> usize {
+    if per_run.is_zero() {
+        return MAX_BATCH;
+    }
+    let runs = MIN_MEASURED_TIME.as_secs_f64() / per_run.as_secs_f64();
+    (runs.ceil() as usize).clamp(1, MAX_BATCH)
+}
+
+/// Operations per second of `iterations` runs taking `elapsed` in total; `None` when no
+/// time was measured, where dividing would give infinity
+pub fn throughput(iterations: usize, elapsed: Duration) -> Option<f64> {
+    let seconds = elapsed.as_secs_f64();
+    (seconds > 0.0).then(|| iterations as f64 / seconds)
+}
+
+/// Average cost of one benchmarked expression
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BenchmarkResult {
+    /// Operation and expression, e.g. `evaluate: Patient.active`
+    pub name: String,
+    pub avg_time_ms: f64,
+    /// 0 when the run was too quick to time
+    pub ops_per_sec: f64,
+    /// Runs timed together as one sample; 0 in baselines saved before it was recorded
+    #[serde(default)]
+    pub batch_size: usize,
+    /// Spread of the per-evaluation time across samples; only evaluations are sampled
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub stats: Option<TimingStats>,
+}
+
+/// Results of a full benchmark run, as saved with `--json` and loaded with `--baseline`
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct BenchmarkOutput {
+    pub generated_at: String,
+    /// Version of the octofhir-fhirpath engine that was measured
+    #[serde(default)]
+    pub engine_version: String,
+    /// Wall-clock time of the whole run in milliseconds
+    #[serde(default)]
+    pub total_time_ms: f64,
+    /// Wall-clock time spent setting up and running benchmarks; the rest went to I/O
+    #[serde(default)]
+    pub benchmark_time_ms: f64,
+    pub results: Vec<BenchmarkResult>,
+}
+
+/// Change in average time of one benchmark relative to the baseline
+#[derive(Debug, Clone, PartialEq)]
+pub struct BaselineComparison {
+    pub name: String,
+    pub baseline_ms: f64,
+    pub current_ms: f64,
+    /// Positive when the current run is slower
+    pub change_percent: f64,
+    pub regression: bool,
+}
+
+/// Compare benchmarks present in both runs; slowdowns beyond `threshold_percent` are regressions
+pub fn compare_to_baseline(
+    baseline: &BenchmarkOutput,
+    current: &BenchmarkOutput,
+    threshold_percent: f64,
+) -> Vec<BaselineComparison> {
+    current
+        .results
+        .iter()
+        .filter_map(|result| {
+            let base = baseline.results.iter().find(|b| b.name == result.name)?;
+            if base.avg_time_ms <= 0.0 {
+                return None;
+            }
+            let change_percent = (result.avg_time_ms - base.avg_time_ms) / base.avg_time_ms * 100.0;
+            Some(BaselineComparison {
+                name: result.name.clone(),
+                baseline_ms: base.avg_time_ms,
+                current_ms: result.avg_time_ms,
+                change_percent,
+                regression: change_percent > threshold_percent,
+            })
+        })
+        .collect()
+}
+
+/// Render baseline comparisons as an aligned text table, regressions marked with `!`
+pub fn baseline_table(comparisons: &[BaselineComparison]) -> String {
+    let width = comparisons
+        .iter()
+        .map(|c| c.name.chars().count())
+        .max()
+        .unwrap_or(0)
+        .max("Benchmark".len());
+
+    let mut table = String::new();
+    let _ = writeln!(
+        table,
+        "  {:<width$}  {:>12}  {:>12}  {:>8}",
+        "Benchmark", "Baseline ms", "Current ms", "Change"
+    );
+    for c in comparisons {
+        let _ = writeln!(
+            table,
+            "{} {:<width$}  {:>12.4}  {:>12.4}  {:>+7.1}%",
+            if c.regression { '!' } else { ' ' },
+            c.name,
+            c.baseline_ms,
+            c.current_ms,
+            c.change_percent
+        );
+    }
+    table
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn quick_runs_are_batched_until_measurable() {
+        let mut calls = 0;
+        let (iterations, elapsed) = run_batched(10, || calls += 1);
+        assert_eq!(iterations, calls);
+        assert_eq!(iterations % 10, 0);
+        assert!(elapsed >= MIN_MEASURED_TIME);
+        assert!(throughput(iterations, elapsed).is_some_and(f64::is_finite));
+        assert_eq!(throughput(100, Duration::ZERO), None);
+        assert_eq!(throughput(100, Duration::from_millis(50)), Some(2000.0));
+    }
+
+    #[test]
+    fn batches_last_at_least_the_measured_time() {
+        assert_eq!(batch_size(Duration::from_millis(5)), 1);
+        assert_eq!(batch_size(Duration::from_micros(300)), 4);
+        assert_eq!(batch_size(Duration::from_nanos(1)), MAX_BATCH);
+        assert_eq!(batch_size(Duration::ZERO), MAX_BATCH);
+    }
+
+    #[test]
+    fn percentiles_use_nearest_rank() {
+        let samples: Vec<f64> = (1..=100).rev().map(f64::from).collect();
+        let stats = TimingStats::from_samples(&samples).unwrap();
+
+        assert_eq!(stats.min_ms, 1.0);
+        assert_eq!(stats.max_ms, 100.0);
+        assert_eq!(stats.p50_ms, 50.0);
+        assert_eq!(stats.p95_ms, 95.0);
+        assert_eq!(stats.p99_ms, 99.0);
+        assert_eq!(samples[0], 100.0);
+    }
+
+    #[test]
+    fn stddev_is_population_deviation() {
+        let stats = TimingStats::from_samples(&[2.0, 4.0, 4.0, 4.0, 5.0, 5.0, 7.0, 9.0]).unwrap();
+        assert_eq!(stats.mean_ms, 5.0);
+        assert_eq!(stats.stddev_ms, 2.0);
+    }
+
+    #[test]
+    fn empty_samples_have_no_stats() {
+        assert!(TimingStats::from_samples(&[]).is_none());
+    }
+
+    fn output(results: &[(&str, f64)]) -> BenchmarkOutput {
+        BenchmarkOutput {
+            generated_at: String::new(),
+            engine_version: String::new(),
+            total_time_ms: 0.0,
+            benchmark_time_ms: 0.0,
+            results: results
+                .iter()
+                .map(|(name, ms)| BenchmarkResult {
+                    name: name.to_string(),
+                    avg_time_ms: *ms,
+                    ops_per_sec: 1000.0 / ms,
+                    batch_size: 1,
+                    stats: None,
+                })
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn slowdowns_beyond_threshold_are_regressions() {
+        let baseline = output(&[
+            ("parse: a", 1.0),
+            ("evaluate: a", 2.0),
+            ("evaluate: b", 1.0),
+        ]);
+        let current = output(&[
+            ("parse: a", 1.05),
+            ("evaluate: a", 2.5),
+            ("evaluate: c", 9.0),
+        ]);
+        let comparisons = compare_to_baseline(&baseline, &current, 10.0);
+
+        assert_eq!(comparisons.len(), 2);
+        assert!(!comparisons[0].regression);
+        assert!(comparisons[1].regression);
+        assert!((comparisons[1].change_percent - 25.0).abs() < 1e-9);
+        assert!(baseline_table(&comparisons).contains("! evaluate: a"));
+    }
+
+    #[test]
+    fn baselines_without_batch_sizes_still_load() {
+        let saved = r#"{"generated_at": "", "results": [
+            {"name": "evaluate: a", "avg_time_ms": 2.0, "ops_per_sec": 500.0}
+        ]}"#;
+        let baseline: BenchmarkOutput = serde_json::from_str(saved).unwrap();
+        assert_eq!(baseline.results[0].batch_size, 0);
+        assert_eq!(baseline.results[0].stats, None);
+
+        let mut current = baseline.clone();
+        current.results[0].stats = TimingStats::from_samples(&[1.0, 2.0, 3.0]);
+        let saved = serde_json::to_string(&current).unwrap();
+        assert!(saved.contains("\"p99_ms\":3.0"), "{saved}");
+        let reloaded: BenchmarkOutput = serde_json::from_str(&saved).unwrap();
+        assert_eq!(reloaded.results[0].stats, current.results[0].stats);
+    }
+}
@@ -1,15 +1,20 @@
 // Convert the official R5 XML FHIRPath tests into grouped JSON suites
 // Usage:
 //   cargo run --bin convert-r5-xml-to-json -- specs/fhirpath/tests/tests-fhir-r5.xml
+//
+// Several suites (such as custom edge-case suites) can be converted together; their
+// group names are then prefixed with the suite's file name to keep them apart:
+//   cargo run --bin convert-r5-xml-to-json -- tests-fhir-r5.xml tests-edge-cases.xml
 
+use fhirpath_dev_tools::test_support::normalize_expression;
 use quick_xml::Reader;
 use quick_xml::events::Event;
 use quick_xml::name::QName;
 use serde::{Deserialize, Serialize};
 use serde_json::Value;
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 use std::fs;
-use std::path::Path;
+use std::path::{Path, PathBuf};
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 struct JsonTestCase {
@@ -40,6 +45,8 @@ struct JsonTestCase {
     mode: Option<String>,
     #[serde(rename = "outputTypes", skip_serializing_if = "Option::is_none")]
     output_types: Option<Vec<String>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    unordered: Option<bool>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -60,27 +67,28 @@ fn unescape_html_entities(text: &str) -> String {
         .replace("&apos;", "'")
 }
 
-fn xml_text_to_value(ty: &str, text: &str) -> Value {
+fn xml_text_to_value(ty: &str, text: &str) -> Result<Value, String> {
     let trimmed = text.trim();
     match ty {
-        "boolean" => match trimmed {
-            "true" | "True" | "TRUE" => Value::Bool(true),
-            "false" | "False" | "FALSE" => Value::Bool(false),
-            _ => Value::Null,
-        },
+        "boolean" => as_bool(trimmed)
+            .map(Value::Bool)
+            .ok_or_else(|| format!("malformed boolean output '{trimmed}'")),
         "integer" => trimmed
             .parse::<i64>()
             .map(|v| Value::Number(v.into()))
-            .unwrap_or(Value::Null),
-        "decimal" => serde_json::Number::from_f64(trimmed.parse::<f64>().unwrap_or(0.0))
+            .map_err(|e| format!("malformed integer output '{trimmed}': {e}")),
+        "decimal" => trimmed
+            .parse::<f64>()
+            .ok()
+            .and_then(serde_json::Number::from_f64)
             .map(Value::Number)
-            .unwrap_or(Value::Null),
+            .ok_or_else(|| format!("malformed decimal output '{trimmed}'")),
         // Strip '@' leading for date types
-        "date" | "dateTime" | "time" => Value::String(unescape_html_entities(
+        "date" | "dateTime" | "time" => Ok(Value::String(unescape_html_entities(
             trimmed.strip_prefix('@').unwrap_or(trimmed),
-        )),
-        "code" | "string" => Value::String(unescape_html_entities(trimmed)),
-        _ => Value::String(unescape_html_entities(trimmed)),
+        ))),
+        "code" | "string" => Ok(Value::String(unescape_html_entities(trimmed))),
+        _ => Ok(Value::String(unescape_html_entities(trimmed))),
     }
 }
 
@@ -106,6 +114,131 @@ fn sanitize_group_name(name: &str) -> String {
         .collect()
 }
 
+/// Make test names unique across the whole suite
+///
+/// A name repeated inside one group cannot be told apart once written and is an error.
+/// A name shared between groups is prefixed with its group (`group.name`) in every
+/// group that uses it. Returns the number of tests renamed.
+fn disambiguate_test_names(groups: &mut HashMap<String, JsonTestSuite>) -> Result<usize, String> {
+    let mut duplicates_in_group = Vec::new();
+    let mut groups_by_name: HashMap<String, Vec<String>> = HashMap::new();
+    for (group_name, suite) in groups.iter() {
+        let mut seen = HashSet::new();
+        for test in &suite.tests {
+            if !seen.insert(test.name.as_str()) {
+                duplicates_in_group.push(format!("{group_name}: {}", test.name));
+            } else {
+                groups_by_name
+                    .entry(test.name.clone())
+                    .or_default()
+                    .push(group_name.clone());
+            }
+        }
+    }
+
+    if !duplicates_in_group.is_empty() {
+        duplicates_in_group.sort();
+        return Err(format!(
+            "duplicate test names within a group:\n  {}",
+            duplicates_in_group.join("\n  ")
+        ));
+    }
+
+    let mut renamed = 0;
+    for (group_name, suite) in groups.iter_mut() {
+        for test in &mut suite.tests {
+            if groups_by_name.get(&test.name).is_some_and(|g| g.len() > 1) {
+                test.name = format!("{group_name}.{}", test.name);
+                renamed += 1;
+            }
+        }
+    }
+    Ok(renamed)
+}
+
+/// Whether `tag` (such as `<output type="string">`) opens or is an element named `name`
+fn is_start_tag(tag: &str, name: &str) -> bool {
+    tag.strip_prefix('<')
+        .and_then(|rest| rest.strip_prefix(name))
+        .is_some_and(|rest| rest.starts_with(|c: char| c == '>' || c == '/' || c.is_whitespace()))
+}
+
+/// Value of attribute `name` in a start tag, without unescaping
+fn raw_attribute<'a>(tag: &'a str, name: &str) -> Option<&'a str> {
+    let pattern = format!("{name}=\"");
+    let mut from = 0;
+    while let Some(found) = tag[from..].find(&pattern) {
+        let at = from + found;
+        let value_start = at + pattern.len();
+        if tag[..at].ends_with(char::is_whitespace) {
+            let len = tag[value_start..].find('"')?;
+            return Some(&tag[value_start..value_start + len]);
+        }
+        from = value_start;
+    }
+    None
+}
+
+/// Number of `<output>` elements of each test, in document order, found by scanning the
+/// raw text rather than with the XML parser
+///
+/// Used to catch outputs the parser drops, such as nested or self-closing ones, which
+/// would silently shrink a test's expected result. Comments and CDATA are skipped.
+fn raw_output_counts(xml: &str) -> Vec<(String, usize)> {
+    let mut counts: Vec<(String, usize)> = Vec::new();
+    let mut rest = xml;
+    while let Some(start) = rest.find('<') {
+        rest = &rest[start..];
+        let skipped = [("<!--", "-->"), ("<![CDATA[", "]]>")]
+            .into_iter()
+            .find(|(open, _)| rest.starts_with(open));
+        if let Some((open, close)) = skipped {
+            let inner = &rest[open.len()..];
+            rest = inner
+                .find(close)
+                .map_or("", |end| &inner[end + close.len()..]);
+            continue;
+        }
+        let tag_end = rest.find('>').map_or(rest.len(), |end| end + 1);
+        let tag = &rest[..tag_end];
+        if is_start_tag(tag, "test") {
+            let name = raw_attribute(tag, "name").unwrap_or_default();
+            counts.push((name.to_string(), 0));
+        } else if is_start_tag(tag, "output")
+            && let Some((_, count)) = counts.last_mut()
+        {
+            *count += 1;
+        }
+        rest = &rest[tag_end..];
+    }
+    counts
+}
+
+/// Warn about tests whose parsed output count differs from a raw scan of the XML
+fn check_output_counts(xml_path: &Path, xml: &str, parsed: &[(String, usize)]) -> usize {
+    let raw = raw_output_counts(xml);
+    if raw.len() != parsed.len() {
+        eprintln!(
+            "⚠️  {}: parsed {} tests but the XML has {}; output counts not checked",
+            xml_path.display(),
+            parsed.len(),
+            raw.len()
+        );
+        return 1;
+    }
+    let mut mismatches = 0;
+    for ((name, parsed_count), (_, raw_count)) in parsed.iter().zip(&raw) {
+        if parsed_count != raw_count {
+            eprintln!(
+                "⚠️  {}: test '{name}' has {raw_count} <output> elements but {parsed_count} were parsed",
+                xml_path.display()
+            );
+            mismatches += 1;
+        }
+    }
+    mismatches
+}
+
 fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, String> {
     let bytes = fs::read(xml_path).map_err(|e| format!("read {}: {}", xml_path.display(), e))?;
     let mut reader = Reader::from_reader(&bytes[..]);
@@ -131,10 +264,13 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
     let mut current_disabled: Option<bool> = None;
     let mut current_predicate: Option<bool> = None;
     let mut current_skip_static: Option<bool> = None;
+    let mut current_unordered: Option<bool> = None;
     let mut current_invalid_kind: Option<String> = None;
     let mut current_expr_mode: Option<String> = None;
 
     let mut groups: HashMap<String, JsonTestSuite> = HashMap::new();
+    // Outputs parsed per test in document order, checked against a raw scan at the end
+    let mut parsed_outputs: Vec<(String, usize)> = Vec::new();
 
     loop {
         match reader.read_event_into(&mut buf) {
@@ -178,6 +314,7 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
                         current_disabled = None;
                         current_predicate = None;
                         current_skip_static = None;
+                        current_unordered = None;
                         current_invalid_kind = None;
                         current_expr_mode = None;
                         for a in e.attributes().flatten() {
@@ -193,6 +330,7 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
                                     "disabled" => current_disabled = as_bool(&v),
                                     "predicate" => current_predicate = as_bool(&v),
                                     "skipStaticCheck" => current_skip_static = as_bool(&v),
+                                    "unordered" => current_unordered = as_bool(&v),
                                     _ => {}
                                 }
                             }
@@ -221,7 +359,7 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
                             }
                         }
 
-                        // Read expression text content (unescaped and trimmed).
+                        // Read expression text content (unescaped, with whitespace normalized).
                         // quick-xml >= 0.41 returns `BytesText`, so unescape it
                         // into an owned string.
                         let expr_text = reader
@@ -229,7 +367,8 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
                             .ok()
                             .map(|t| t.decode().unwrap_or_default().into_owned())
                             .unwrap_or_default();
-                        current_expression = unescape_html_entities(expr_text.trim());
+                        current_expression =
+                            normalize_expression(&unescape_html_entities(&expr_text));
                     }
                     "output" => {
                         // Capture output type
@@ -253,7 +392,9 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
                             .map(|t| t.decode().unwrap_or_default().into_owned())
                             .unwrap_or_default();
                         let ty = _current_output_type.as_deref().unwrap_or("string");
-                        current_expected.push(xml_text_to_value(ty, &out_text));
+                        let value = xml_text_to_value(ty, &out_text)
+                            .map_err(|e| format!("test '{current_test_name}': {e}"))?;
+                        current_expected.push(value);
                         current_output_types.push(ty.to_string());
                         _current_output_type = None;
                     }
@@ -289,8 +430,11 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
                                 } else {
                                     Some(current_output_types.clone())
                                 },
+                                unordered: current_unordered,
                             };
 
+                            parsed_outputs
+                                .push((current_test_name.clone(), current_expected.len()));
                             if let Some(suite) = groups.get_mut(&current_group_name) {
                                 suite.tests.push(case);
                             }
@@ -311,26 +455,66 @@ fn parse_groups(xml_path: &Path) -> Result<HashMap<String, JsonTestSuite>, Strin
         buf.clear();
     }
 
+    let mismatches =
+        check_output_counts(xml_path, &String::from_utf8_lossy(&bytes), &parsed_outputs);
+    if mismatches > 0 {
+        eprintln!(
+            "⚠️  {}: {mismatches} output count mismatches; expected results may be incomplete",
+            xml_path.display()
+        );
+    }
+
     Ok(groups)
 }
 
 fn main() -> Result<(), Box<dyn std::error::Error>> {
     let args: Vec<String> = std::env::args().collect();
-    if args.len() != 2 {
-        eprintln!("Usage: {} <path-to-tests-fhir-r5.xml>", args[0]);
+    if args.len() < 2 {
+        eprintln!("Usage: {} <suite.xml>...", args[0]);
         std::process::exit(1);
     }
-    let xml_path = Path::new(&args[1]);
-    println!("📖 Converting XML: {}", xml_path.display());
+    let xml_paths: Vec<PathBuf> = args[1..].iter().map(PathBuf::from).collect();
+    let prefix_groups = xml_paths.len() > 1;
+
+    // Merge the groups of all suites; each group is written next to its own XML file
+    let mut groups = HashMap::new();
+    let mut out_dirs = HashMap::new();
+    for xml_path in &xml_paths {
+        println!("📖 Converting XML: {}", xml_path.display());
+        let suite_groups = parse_groups(xml_path)
+            .map_err(|e| format!("Parse failed for {}: {e}", xml_path.display()))?;
+        let suite_name = xml_path
+            .file_stem()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .into_owned();
+        let out_dir = xml_path.parent().unwrap_or_else(|| Path::new("."));
+        for (group_name, mut suite) in suite_groups {
+            let group_name = if prefix_groups {
+                let prefixed = format!("{suite_name}-{group_name}");
+                suite.name = prefixed.clone();
+                suite.source = Some(suite_name.clone());
+                prefixed
+            } else {
+                group_name
+            };
+            if groups.insert(group_name.clone(), suite).is_some() {
+                return Err(format!("group '{group_name}' appears in more than one suite").into());
+            }
+            out_dirs.insert(group_name, out_dir.to_path_buf());
+        }
+    }
 
-    let groups = parse_groups(xml_path).map_err(|e| format!("Parse failed: {e}"))?;
+    let renamed = disambiguate_test_names(&mut groups)?;
+    if renamed > 0 {
+        println!("🔀 Prefixed {renamed} tests whose names are shared between groups");
+    }
 
-    // Write JSON suites into the same directory as the XML file
-    let out_dir = xml_path.parent().unwrap_or_else(|| Path::new("."));
+    // Write JSON suites into the same directory as their XML file
     let mut files_written = 0usize;
     for (group_name, suite) in groups {
         let file_name = format!("{}.json", sanitize_group_name(&group_name));
-        let path = out_dir.join(file_name);
+        let path = out_dirs[&group_name].join(file_name);
         let json = serde_json::to_string_pretty(&suite)?;
         fs::write(&path, json)?;
         files_written += 1;
@@ -1,12 +1,62 @@
 use anyhow::Result;
 use clap::{Parser, Subcommand};
+use fhirpath_dev_tools::bench_stats::{
+    BenchmarkOutput, BenchmarkResult, TimingStats, baseline_table, batch_size, compare_to_baseline,
+    run_batched, throughput,
+};
+use fhirpath_dev_tools::fhir_xml::parse_input_bytes;
+use fhirpath_dev_tools::logging::{self, LogFormat, LogLevel};
+use log::{info, warn};
 use octofhir_fhir_model::FhirVersion;
 use std::fs;
 use std::path::{Path, PathBuf};
 
 // Memory and system info
+use std::alloc::{GlobalAlloc, Layout, System as SystemAllocator};
+use std::sync::atomic::{AtomicU64, Ordering};
 use sysinfo::{Pid, ProcessesToUpdate, System};
 
+/// Global allocator that counts allocations so benchmarks can report per-evaluation costs
+struct CountingAllocator;
+
+static ALLOCATIONS: AtomicU64 = AtomicU64::new(0);
+static ALLOCATED_BYTES: AtomicU64 = AtomicU64::new(0);
+
+unsafe impl GlobalAlloc for CountingAllocator {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        ALLOCATED_BYTES.fetch_add(layout.size() as u64, Ordering::Relaxed);
+        unsafe { SystemAllocator.alloc(layout) }
+    }
+
+    unsafe fn alloc_zeroed(&self, layout: Layout) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        ALLOCATED_BYTES.fetch_add(layout.size() as u64, Ordering::Relaxed);
+        unsafe { SystemAllocator.alloc_zeroed(layout) }
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        ALLOCATED_BYTES.fetch_add(new_size as u64, Ordering::Relaxed);
+        unsafe { SystemAllocator.realloc(ptr, layout, new_size) }
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        unsafe { SystemAllocator.dealloc(ptr, layout) }
+    }
+}
+
+#[global_allocator]
+static GLOBAL: CountingAllocator = CountingAllocator;
+
+/// Snapshot of (allocation count, allocated bytes) since process start
+fn allocation_snapshot() -> (u64, u64) {
+    (
+        ALLOCATIONS.load(Ordering::Relaxed),
+        ALLOCATED_BYTES.load(Ordering::Relaxed),
+    )
+}
+
 /// Format numbers in human-friendly format (K, M, etc.)
 fn format_ops_per_sec(ops_per_sec: f64) -> String {
     if ops_per_sec >= 1_000_000.0 {
@@ -18,12 +68,23 @@ fn format_ops_per_sec(ops_per_sec: f64) -> String {
     }
 }
 
+/// Format a throughput from [`throughput`], which is `None` for runs too quick to time
+fn format_throughput(ops_per_sec: Option<f64>) -> String {
+    ops_per_sec.map_or_else(|| "n/a ops/sec".to_string(), format_ops_per_sec)
+}
+
 #[derive(Parser)]
 #[command(name = "fhirpath-bench")]
 #[command(about = "FHIRPath-rs benchmarking and profiling tool")]
 struct Cli {
     #[command(subcommand)]
     command: Commands,
+    /// Most detailed log messages to show
+    #[arg(long, global = true, value_enum, default_value_t = LogLevel::Info)]
+    log_level: LogLevel,
+    /// Write log messages as JSON lines instead of text
+    #[arg(long, global = true)]
+    log_json: bool,
 }
 
 #[derive(Subcommand)]
@@ -39,14 +100,20 @@ enum Commands {
         #[arg(short, long, default_value = "1000")]
         iterations: usize,
         /// Use bundle data instead of patient data
-        #[arg(short, long)]
+        #[arg(short, long, conflicts_with = "input")]
         bundle: bool,
+        /// Input resource (JSON or XML), as a path or a file name under test-cases/input
+        #[arg(long)]
+        input: Option<PathBuf>,
         /// Generate a CPU flamegraph using pprof
         #[arg(long, default_value_t = false)]
         flame: bool,
         /// Sampling frequency (Hz) for pprof (only if --flame)
         #[arg(long, default_value_t = 99)]
         freq: i32,
+        /// Untimed iterations to run before measuring
+        #[arg(long, default_value_t = 100)]
+        warmup: usize,
     },
     /// Generate benchmark.md file with results
     Benchmark {
@@ -56,6 +123,18 @@ enum Commands {
         /// Run actual benchmarks (otherwise just generates template)
         #[arg(short, long)]
         run: bool,
+        /// Untimed evaluations to run per expression before measuring
+        #[arg(long, default_value_t = 100)]
+        warmup: usize,
+        /// Also write machine-readable results to this JSON file
+        #[arg(long, requires = "run")]
+        json: Option<PathBuf>,
+        /// Compare against results previously saved with --json and fail on regressions
+        #[arg(long, requires = "run")]
+        baseline: Option<PathBuf>,
+        /// Slowdown in average time, in percent, that counts as a regression
+        #[arg(long, default_value_t = 10.0)]
+        threshold: f64,
     },
     /// List available expressions for benchmarking
     List,
@@ -161,7 +240,7 @@ pub fn get_sample_bundle() -> serde_json::Value {
     {
         Ok(content) => {
             serde_json::from_str(&content).unwrap_or_else(|e| {
-                eprintln!("Failed to parse bundle-medium.json: {e}");
+                warn!("Failed to parse bundle-medium.json: {e}");
                 // Fallback to a minimal bundle structure
                 serde_json::json!({
                     "resourceType": "Bundle",
@@ -176,10 +255,8 @@ pub fn get_sample_bundle() -> serde_json::Value {
             })
         }
         Err(e) => {
-            eprintln!("Failed to read bundle-medium.json: {e}");
-            eprintln!(
-                "Using fallback bundle. Make sure to run benchmarks from the workspace root."
-            );
+            warn!("Failed to read bundle-medium.json: {e}");
+            warn!("Using fallback bundle. Make sure to run benchmarks from the workspace root.");
             // Fallback to a minimal bundle structure
             serde_json::json!({
                 "resourceType": "Bundle",
@@ -197,9 +274,14 @@ pub fn get_sample_bundle() -> serde_json::Value {
 
 #[tokio::main]
 async fn main() -> Result<()> {
-    env_logger::init();
-
     let cli = Cli::parse();
+    let log_format = if cli.log_json {
+        LogFormat::Json
+    } else {
+        LogFormat::Text
+    };
+    logging::init(env!("CARGO_CRATE_NAME"), cli.log_level, log_format)
+        .map_err(anyhow::Error::msg)?;
 
     match cli.command {
         Commands::Profile {
@@ -207,28 +289,71 @@ async fn main() -> Result<()> {
             output,
             iterations,
             bundle,
+            input,
             flame,
             freq,
+            warmup,
         } => {
-            println!("Profiling expression: {expression}");
-            println!("Output directory: {}", output.display());
-            println!("Iterations: {iterations}");
-            println!("Using {} data", if bundle { "bundle" } else { "patient" });
+            info!("Profiling expression: {expression}");
+            info!("Output directory: {}", output.display());
+            info!("Iterations: {iterations} (warmup: {warmup})");
+            let data = match &input {
+                Some(path) => load_input_resource(path)?,
+                None if bundle => get_sample_bundle(),
+                None => get_sample_patient(),
+            };
+            let data_label = match &input {
+                Some(path) => path.display().to_string(),
+                None if bundle => "Bundle".to_string(),
+                None => "Patient".to_string(),
+            };
+            info!("Using {data_label} data");
             if flame {
-                println!("Flamegraph: enabled (freq={freq} Hz)");
+                info!("Flamegraph: enabled (freq={freq} Hz)");
             }
 
-            profile_expression(&expression, output, iterations, bundle, flame, freq).await?;
+            let options = ProfileOptions {
+                iterations,
+                warmup,
+                flame,
+                freq,
+            };
+            profile_expression(&expression, output, &data, &data_label, options).await?;
         }
-        Commands::Benchmark { output, run } => {
+        Commands::Benchmark {
+            output,
+            run,
+            warmup,
+            json,
+            baseline,
+            threshold,
+        } => {
             if run {
-                println!("Running benchmarks and generating results...");
-                run_benchmarks_and_generate(&output).await?;
+                // Load the baseline up front so a bad path fails before the run
+                let baseline = match &baseline {
+                    Some(path) => Some(load_benchmark_output(path)?),
+                    None => None,
+                };
+                info!("Running benchmarks and generating results...");
+                let results = run_benchmarks_and_generate(&output, warmup).await?;
+                if let Some(path) = &json {
+                    fs::write(path, serde_json::to_string_pretty(&results)?)?;
+                    info!("Benchmark JSON written to: {}", path.display());
+                }
+                info!(
+                    "Total time: {:.0}ms (benchmarks {:.0}ms, I/O {:.0}ms)",
+                    results.total_time_ms,
+                    results.benchmark_time_ms,
+                    results.total_time_ms - results.benchmark_time_ms
+                );
+                if let Some(baseline) = &baseline {
+                    check_baseline(baseline, &results, threshold)?;
+                }
             } else {
-                println!("Generating benchmark template...");
+                info!("Generating benchmark template...");
                 let content = generate_benchmark_summary();
                 fs::write(&output, content)?;
-                println!("Benchmark template written to: {}", output.display());
+                info!("Benchmark template written to: {}", output.display());
             }
         }
         Commands::List => {
@@ -239,14 +364,75 @@ async fn main() -> Result<()> {
     Ok(())
 }
 
-async fn profile_expression(
-    expression: &str,
-    output_dir: PathBuf,
+/// Load results saved by a previous `benchmark --run --json` invocation
+fn load_benchmark_output(path: &Path) -> Result<BenchmarkOutput> {
+    let content = fs::read_to_string(path)
+        .map_err(|e| anyhow::anyhow!("Failed to read baseline {}: {e}", path.display()))?;
+    serde_json::from_str(&content)
+        .map_err(|e| anyhow::anyhow!("Failed to parse baseline {}: {e}", path.display()))
+}
+
+/// Print the comparison with the baseline and fail if any benchmark regressed
+fn check_baseline(
+    baseline: &BenchmarkOutput,
+    current: &BenchmarkOutput,
+    threshold: f64,
+) -> Result<()> {
+    let comparisons = compare_to_baseline(baseline, current, threshold);
+    info!(
+        "\nComparison with baseline ({} benchmarks, threshold {threshold}%):",
+        comparisons.len()
+    );
+    if !baseline.engine_version.is_empty() {
+        info!(
+            "Engine: v{} (baseline) vs v{} (current)",
+            baseline.engine_version, current.engine_version
+        );
+    }
+    info!("{}", baseline_table(&comparisons).trim_end());
+
+    let regressions = comparisons.iter().filter(|c| c.regression).count();
+    if regressions > 0 {
+        anyhow::bail!("{regressions} benchmark(s) regressed by more than {threshold}%");
+    }
+    info!("✅ No regressions beyond {threshold}%");
+    Ok(())
+}
+
+/// Load a benchmark input resource from a path or from test-cases/input
+fn load_input_resource(path: &Path) -> Result<serde_json::Value> {
+    let resolved = if path.exists() {
+        path.to_path_buf()
+    } else {
+        Path::new("test-cases/input").join(path)
+    };
+    let content = fs::read(&resolved)
+        .map_err(|e| anyhow::anyhow!("Failed to read input file {}: {e}", resolved.display()))?;
+    parse_input_bytes(&resolved.to_string_lossy(), &content)
+        .map_err(|e| anyhow::anyhow!("Failed to parse input file {}: {e}", resolved.display()))
+}
+
+/// Iteration and profiler settings for the profile command
+struct ProfileOptions {
     iterations: usize,
-    use_bundle: bool,
+    warmup: usize,
     flame: bool,
     freq: i32,
+}
+
+async fn profile_expression(
+    expression: &str,
+    output_dir: PathBuf,
+    data: &serde_json::Value,
+    data_label: &str,
+    options: ProfileOptions,
 ) -> Result<()> {
+    let ProfileOptions {
+        iterations,
+        warmup,
+        flame,
+        freq,
+    } = options;
     use octofhir_fhirpath::FhirPathEngine;
     use octofhir_fhirschema::EmbeddedSchemaProvider;
     use std::sync::Arc;
@@ -254,7 +440,7 @@ async fn profile_expression(
     // Create output directory if it doesn't exist
     std::fs::create_dir_all(&output_dir)?;
 
-    println!("Setting up profiling environment...");
+    info!("Setting up profiling environment...");
 
     // Initialize engine
     let registry = Arc::new(octofhir_fhirpath::create_function_registry());
@@ -262,19 +448,51 @@ async fn profile_expression(
         as Arc<dyn octofhir_fhir_model::ModelProvider + Send + Sync>;
     let engine = FhirPathEngine::new(registry, model_provider.clone()).await?;
 
-    // Get test data
-    let data = if use_bundle {
-        get_sample_bundle()
-    } else {
-        get_sample_patient()
-    };
+    // Warm up caches and lazy initialization before anything is measured
+    for _ in 0..warmup {
+        let collection = octofhir_fhirpath::Collection::single(
+            octofhir_fhirpath::FhirPathValue::resource(data.clone()),
+        );
+        let ctx = octofhir_fhirpath::EvaluationContext::new(
+            collection,
+            model_provider.clone(),
+            None,
+            None,
+            None,
+        );
+        let _ = engine.evaluate(expression, &ctx).await;
+    }
 
-    println!("Running {iterations} iterations...");
+    // Time batches of evaluations per sample, so quick expressions are not lost in the
+    // resolution of the clock
+    let calibration_runs = 10;
+    let collection = octofhir_fhirpath::Collection::single(
+        octofhir_fhirpath::FhirPathValue::resource(data.clone()),
+    );
+    let ctx = octofhir_fhirpath::EvaluationContext::new(
+        collection,
+        model_provider.clone(),
+        None,
+        None,
+        None,
+    );
+    let calibration_start = std::time::Instant::now();
+    for _ in 0..calibration_runs {
+        let _ = engine.evaluate(expression, &ctx).await;
+    }
+    let batch = batch_size(calibration_start.elapsed() / calibration_runs);
+
+    info!("Running {iterations} iterations of {batch} evaluations each...");
+
+    // Measure parse cost on its own; evaluation below reuses the engine's cached AST
+    let (parse_iterations, parse_duration) = run_batched(iterations, || {
+        let _ = octofhir_fhirpath::parse_expression(expression);
+    });
 
     // Optional CPU profiling
     let mut flamegraph_path: Option<PathBuf> = None;
     let do_flame = if flame && cfg!(all(target_os = "macos", target_arch = "aarch64")) {
-        eprintln!(
+        warn!(
             "⚠️  Skipping flamegraph on macOS aarch64 due to known profiler instability. Use Linux for flamegraphs."
         );
         false
@@ -285,7 +503,7 @@ async fn profile_expression(
         match pprof::ProfilerGuard::new(freq) {
             Ok(guard) => Some(guard),
             Err(e) => {
-                eprintln!("Failed to start pprof profiler: {e}");
+                warn!("Failed to start pprof profiler: {e}");
                 None
             }
         }
@@ -294,10 +512,12 @@ async fn profile_expression(
     };
 
     // Measure timing
+    let mut samples_ms = Vec::with_capacity(iterations);
+    let allocations_before = allocation_snapshot();
     let start = std::time::Instant::now();
     for i in 0..iterations {
         if i % 100 == 0 && i > 0 {
-            println!("Completed {i} iterations");
+            info!("Completed {i} iterations");
         }
         let collection = octofhir_fhirpath::Collection::single(
             octofhir_fhirpath::FhirPathValue::resource(data.clone()),
@@ -309,9 +529,21 @@ async fn profile_expression(
             None,
             None,
         );
-        let _ = engine.evaluate(expression, &ctx).await;
+        let sample_start = std::time::Instant::now();
+        for _ in 0..batch {
+            let _ = engine.evaluate(expression, &ctx).await;
+        }
+        samples_ms.push(sample_start.elapsed().as_secs_f64() * 1000.0 / batch as f64);
     }
     let duration = start.elapsed();
+    let evaluations = iterations * batch;
+    let allocations_after = allocation_snapshot();
+    let stats = TimingStats::from_samples(&samples_ms);
+    // Includes building the input collection and context once per iteration
+    let allocs_per_op =
+        allocations_after.0.saturating_sub(allocations_before.0) as f64 / evaluations as f64;
+    let bytes_per_op =
+        allocations_after.1.saturating_sub(allocations_before.1) as f64 / evaluations as f64;
 
     // Generate flamegraph if enabled
     if let Some(guard) = profiler {
@@ -338,26 +570,43 @@ async fn profile_expression(
             Ok(report) => match File::create(&path) {
                 Ok(mut file) => {
                     if let Err(e) = report.flamegraph(&mut file) {
-                        eprintln!("Failed to write flamegraph: {e}");
+                        warn!("Failed to write flamegraph: {e}");
                     } else {
                         flamegraph_path = Some(path);
                     }
                 }
-                Err(e) => eprintln!("Failed to create flamegraph file: {e}"),
+                Err(e) => warn!("Failed to create flamegraph file: {e}"),
             },
-            Err(e) => eprintln!("Failed to build pprof report: {e}"),
+            Err(e) => warn!("Failed to build pprof report: {e}"),
         }
     }
 
-    let avg_time_ms = duration.as_millis() as f64 / iterations as f64;
-    let ops_per_sec = iterations as f64 / duration.as_secs_f64();
+    let avg_time_ms = duration.as_secs_f64() * 1000.0 / evaluations as f64;
+    let ops_per_sec = throughput(evaluations, duration);
+    let parse_time_ms = parse_duration.as_secs_f64() * 1000.0 / parse_iterations as f64;
+    let parse_ops_per_sec = throughput(parse_iterations, parse_duration);
+    if ops_per_sec.is_none() {
+        warn!("⚠️  {evaluations} evaluations took no measurable time; run more for a throughput");
+    }
 
-    println!("Profiling completed!");
-    println!("Total time: {:.2}s", duration.as_secs_f64());
-    println!("Average time per iteration: {avg_time_ms:.2}ms");
-    println!("Operations per second: {}", format_ops_per_sec(ops_per_sec));
+    info!("Profiling completed!");
+    info!("Total time: {:.2}s", duration.as_secs_f64());
+    info!("Batch size: {batch} evaluations per timed sample");
+    info!("Average time per evaluation: {avg_time_ms:.4}ms");
+    info!("Operations per second: {}", format_throughput(ops_per_sec));
+    info!(
+        "Parse time per iteration: {parse_time_ms:.4}ms ({})",
+        format_throughput(parse_ops_per_sec)
+    );
+    if let Some(stats) = &stats {
+        info!("{}", format_timing_stats(stats).trim_end());
+    }
+    info!(
+        "Allocations per evaluation: {allocs_per_op:.1} ({} per evaluation)",
+        format_bytes(bytes_per_op as u64)
+    );
     if let Some(ref p) = flamegraph_path {
-        println!("Flamegraph written to: {}", p.display());
+        info!("Flamegraph written to: {}", p.display());
     }
 
     // Write results to file
@@ -365,27 +614,48 @@ async fn profile_expression(
     let mut results_content = format!(
         "Expression: {}\n\
          Iterations: {}\n\
+         Batch size: {}\n\
          Data type: {}\n\
          Total time: {:.2}s\n\
-         Average time per iteration: {:.2}ms\n\
-         Operations per second: {}\n",
+         Average time per evaluation: {:.4}ms\n\
+         Operations per second: {}\n\
+         Parse time per iteration: {:.4}ms\n\
+         Parse operations per second: {}\n\
+         Allocations per evaluation: {:.1}\n\
+         Bytes allocated per evaluation: {:.0}\n",
         expression,
         iterations,
-        if use_bundle { "Bundle" } else { "Patient" },
+        batch,
+        data_label,
         duration.as_secs_f64(),
         avg_time_ms,
-        format_ops_per_sec(ops_per_sec)
+        format_throughput(ops_per_sec),
+        parse_time_ms,
+        format_throughput(parse_ops_per_sec),
+        allocs_per_op,
+        bytes_per_op
     );
+    if let Some(stats) = &stats {
+        results_content.push_str(&format_timing_stats(stats));
+    }
     if let Some(p) = &flamegraph_path {
         results_content.push_str(&format!("Flamegraph: {}\n", p.display()));
     }
 
     fs::write(&results_file, results_content)?;
-    println!("Results written to: {}", results_file.display());
+    info!("Results written to: {}", results_file.display());
 
     Ok(())
 }
 
+fn format_timing_stats(stats: &TimingStats) -> String {
+    format!(
+        "Evaluation time (ms): min {:.3}, p50 {:.3}, p95 {:.3}, p99 {:.3}, max {:.3}\n\
+         Standard deviation: {:.3}ms\n",
+        stats.min_ms, stats.p50_ms, stats.p95_ms, stats.p99_ms, stats.max_ms, stats.stddev_ms
+    )
+}
+
 fn list_expressions() {
     let expressions = BenchmarkExpressions::default();
 
@@ -409,6 +679,7 @@ fn list_expressions() {
     println!("\nTo profile a specific expression:");
     println!("  fhirpath-bench profile \"Patient.active\"");
     println!("  fhirpath-bench profile \"Bundle.entry.resource.count()\" --bundle");
+    println!("  fhirpath-bench profile \"Observation.value\" --input observation-example.json");
 }
 
 fn get_rss_bytes() -> Option<u64> {
@@ -453,26 +724,30 @@ fn parse_ops_value(s: &str) -> Option<f64> {
     }
 }
 
-async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
+async fn run_benchmarks_and_generate(output_path: &Path, warmup: usize) -> Result<BenchmarkOutput> {
     use octofhir_fhirpath::FhirPathEngine;
     use octofhir_fhirpath::parse_expression;
     use octofhir_fhirschema::EmbeddedSchemaProvider;
 
     use std::sync::Arc;
-    use std::time::Instant;
+    use std::time::{Duration, Instant};
+
+    // Parses timed together per batch
+    const PARSE_BATCH: usize = 1000;
 
-    println!("Running benchmarks directly...");
+    info!("Running benchmarks directly...");
     let mem_start = get_rss_bytes();
     let start = Instant::now();
 
     let expressions = BenchmarkExpressions::default();
     let mut results = Vec::new();
+    let mut measurements = Vec::new();
 
     // Setup for evaluation benchmarks
     let registry = Arc::new(octofhir_fhirpath::create_function_registry());
 
     // Use real FhirSchemaModelProvider with R5 for accurate benchmarks
-    println!("Initializing EmbeddedModelProvider R5...");
+    info!("Initializing EmbeddedModelProvider R5...");
     let model_provider = Arc::new(EmbeddedSchemaProvider::new(FhirVersion::R5))
         as Arc<dyn octofhir_fhir_model::ModelProvider + Send + Sync>;
 
@@ -481,43 +756,53 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
     let bundle_data = get_sample_bundle();
 
     // Helper function to run benchmarks and measure performance
-    let run_tokenize_benchmark = |name: &str, expressions: &[&str]| -> Vec<String> {
+    let run_tokenize_benchmark = |name: &str,
+                                  expressions: &[&str],
+                                  measurements: &mut Vec<BenchmarkResult>|
+     -> Vec<String> {
         let mut bench_results = Vec::new();
-        println!("  Running {name} benchmarks...");
+        info!("  Running {name} benchmarks...");
 
         for expr in expressions {
-            let iterations = 1000;
-            let start_time = Instant::now();
-
-            for _ in 0..iterations {
+            let (iterations, elapsed) = run_batched(PARSE_BATCH, || {
                 let _ = parse_expression(expr);
-            }
-
-            let elapsed = start_time.elapsed();
-            let ops_per_sec = (iterations as f64) / elapsed.as_secs_f64();
-
-            bench_results.push(format!("  - `{expr}`: {}", format_ops_per_sec(ops_per_sec)));
+            });
+            let ops_per_sec = throughput(iterations, elapsed);
+            measurements.push(BenchmarkResult {
+                name: format!("tokenize: {expr}"),
+                avg_time_ms: elapsed.as_secs_f64() * 1000.0 / iterations as f64,
+                ops_per_sec: ops_per_sec.unwrap_or_default(),
+                batch_size: PARSE_BATCH,
+                stats: None,
+            });
+
+            bench_results.push(format!("  - `{expr}`: {}", format_throughput(ops_per_sec)));
         }
 
         bench_results
     };
 
-    let run_parse_benchmark = |name: &str, expressions: &[&str]| -> Vec<String> {
+    let run_parse_benchmark = |name: &str,
+                               expressions: &[&str],
+                               measurements: &mut Vec<BenchmarkResult>|
+     -> Vec<String> {
         let mut bench_results = Vec::new();
-        println!("  Running {name} benchmarks...");
+        info!("  Running {name} benchmarks...");
 
         for expr in expressions {
-            let iterations = 1000;
-            let start_time = Instant::now();
-
-            for _ in 0..iterations {
+            let (iterations, elapsed) = run_batched(PARSE_BATCH, || {
                 let _ = parse_expression(expr);
-            }
-
-            let elapsed = start_time.elapsed();
-            let ops_per_sec = (iterations as f64) / elapsed.as_secs_f64();
-
-            bench_results.push(format!("  - `{expr}`: {}", format_ops_per_sec(ops_per_sec)));
+            });
+            let ops_per_sec = throughput(iterations, elapsed);
+            measurements.push(BenchmarkResult {
+                name: format!("parse: {expr}"),
+                avg_time_ms: elapsed.as_secs_f64() * 1000.0 / iterations as f64,
+                ops_per_sec: ops_per_sec.unwrap_or_default(),
+                batch_size: PARSE_BATCH,
+                stats: None,
+            });
+
+            bench_results.push(format!("  - `{expr}`: {}", format_throughput(ops_per_sec)));
         }
 
         bench_results
@@ -529,18 +814,17 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
         expressions: &[&str],
         data: &serde_json::Value,
         engine: &FhirPathEngine,
-        model_provider: Arc<dyn octofhir_fhir_model::ModelProvider + Send + Sync>,
         record_memory: bool,
+        warmup: usize,
+        measurements: &mut Vec<BenchmarkResult>,
     ) -> Vec<String> {
         let mut bench_results = Vec::new();
-        println!("  Running {name} benchmarks...");
+        let model_provider = engine.get_model_provider();
+        info!("  Running {name} benchmarks...");
 
         for expr in expressions {
-            let iterations = 100; // Fewer iterations for evaluation (more expensive)
-            let mem_before = if record_memory { get_rss_bytes() } else { None };
-            let start_time = Instant::now();
-
-            for _ in 0..iterations {
+            let iterations = 100; // Fewer samples for evaluation (more expensive)
+            for _ in 0..warmup {
                 let collection = octofhir_fhirpath::Collection::single(
                     octofhir_fhirpath::FhirPathValue::resource(data.clone()),
                 );
@@ -553,9 +837,58 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
                 );
                 let _ = engine.evaluate(expr, &ctx).await;
             }
+            // Time batches of evaluations per sample, so quick expressions are not lost in
+            // the resolution of the clock
+            let calibration_runs = 10;
+            let collection = octofhir_fhirpath::Collection::single(
+                octofhir_fhirpath::FhirPathValue::resource(data.clone()),
+            );
+            let ctx = octofhir_fhirpath::EvaluationContext::new(
+                collection,
+                model_provider.clone(),
+                None,
+                None,
+                None,
+            );
+            let calibration_start = Instant::now();
+            for _ in 0..calibration_runs {
+                let _ = engine.evaluate(expr, &ctx).await;
+            }
+            let batch = batch_size(calibration_start.elapsed() / calibration_runs);
 
-            let elapsed = start_time.elapsed();
-            let ops_per_sec = (iterations as f64) / elapsed.as_secs_f64();
+            let mem_before = if record_memory { get_rss_bytes() } else { None };
+            let mut elapsed = Duration::ZERO;
+            let mut samples_ms = Vec::with_capacity(iterations);
+            for _ in 0..iterations {
+                let collection = octofhir_fhirpath::Collection::single(
+                    octofhir_fhirpath::FhirPathValue::resource(data.clone()),
+                );
+                let ctx = octofhir_fhirpath::EvaluationContext::new(
+                    collection,
+                    model_provider.clone(),
+                    None,
+                    None,
+                    None,
+                );
+                let sample_start = Instant::now();
+                for _ in 0..batch {
+                    let _ = engine.evaluate(expr, &ctx).await;
+                }
+                let sample = sample_start.elapsed();
+                elapsed += sample;
+                samples_ms.push(sample.as_secs_f64() * 1000.0 / batch as f64);
+            }
+            let stats = TimingStats::from_samples(&samples_ms);
+
+            let evaluations = iterations * batch;
+            let ops_per_sec = throughput(evaluations, elapsed);
+            measurements.push(BenchmarkResult {
+                name: format!("evaluate: {expr}"),
+                avg_time_ms: elapsed.as_secs_f64() * 1000.0 / evaluations as f64,
+                ops_per_sec: ops_per_sec.unwrap_or_default(),
+                batch_size: batch,
+                stats,
+            });
 
             let mem_suffix = if record_memory {
                 if let (Some(ms), Some(me)) = (mem_before, get_rss_bytes()) {
@@ -568,9 +901,18 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
                 String::new()
             };
 
+            let tail_suffix = stats
+                .map(|s| {
+                    format!(
+                        " (p50 {:.3}ms, p95 {:.3}ms, p99 {:.3}ms)",
+                        s.p50_ms, s.p95_ms, s.p99_ms
+                    )
+                })
+                .unwrap_or_default();
             bench_results.push(format!(
-                "  - `{expr}`: {}{}",
-                format_ops_per_sec(ops_per_sec),
+                "  - `{expr}`: {}{}{}",
+                format_throughput(ops_per_sec),
+                tail_suffix,
                 mem_suffix
             ));
         }
@@ -583,21 +925,36 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
     results.extend(run_tokenize_benchmark(
         "Simple Tokenization",
         &expressions.simple,
+        &mut measurements,
     ));
     results.extend(run_tokenize_benchmark(
         "Medium Tokenization",
         &expressions.medium,
+        &mut measurements,
     ));
     results.extend(run_tokenize_benchmark(
         "Complex Tokenization",
         &expressions.complex,
+        &mut measurements,
     ));
 
     // Run parsing benchmarks
     results.push("\n## Parsing Benchmarks".to_string());
-    results.extend(run_parse_benchmark("Simple Parsing", &expressions.simple));
-    results.extend(run_parse_benchmark("Medium Parsing", &expressions.medium));
-    results.extend(run_parse_benchmark("Complex Parsing", &expressions.complex));
+    results.extend(run_parse_benchmark(
+        "Simple Parsing",
+        &expressions.simple,
+        &mut measurements,
+    ));
+    results.extend(run_parse_benchmark(
+        "Medium Parsing",
+        &expressions.medium,
+        &mut measurements,
+    ));
+    results.extend(run_parse_benchmark(
+        "Complex Parsing",
+        &expressions.complex,
+        &mut measurements,
+    ));
 
     // Run evaluation benchmarks
     results.push("\n## Evaluation Benchmarks".to_string());
@@ -607,8 +964,9 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
             &expressions.simple,
             &patient_data,
             &engine,
-            model_provider.clone(),
             false,
+            warmup,
+            &mut measurements,
         )
         .await,
     );
@@ -618,8 +976,9 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
             &expressions.medium,
             &patient_data,
             &engine,
-            model_provider.clone(),
             false,
+            warmup,
+            &mut measurements,
         )
         .await,
     );
@@ -629,14 +988,15 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
             &expressions.complex,
             &bundle_data,
             &engine,
-            model_provider.clone(),
             true,
+            warmup,
+            &mut measurements,
         )
         .await,
     );
 
     let duration = start.elapsed();
-    println!("Benchmarks completed in {:.2}s", duration.as_secs_f64());
+    info!("Benchmarks completed in {:.2}s", duration.as_secs_f64());
 
     let mem_end = get_rss_bytes();
 
@@ -645,9 +1005,15 @@ async fn run_benchmarks_and_generate(output_path: &Path) -> Result<()> {
     let markdown_content = parse_and_format_results(&benchmark_output, mem_start.zip(mem_end));
 
     fs::write(output_path, markdown_content)?;
-    println!("Benchmark results written to: {}", output_path.display());
-
-    Ok(())
+    info!("Benchmark results written to: {}", output_path.display());
+
+    Ok(BenchmarkOutput {
+        generated_at: chrono::Utc::now().to_rfc3339(),
+        engine_version: octofhir_fhirpath::VERSION.to_string(),
+        total_time_ms: start.elapsed().as_secs_f64() * 1000.0,
+        benchmark_time_ms: duration.as_secs_f64() * 1000.0,
+        results: measurements,
+    })
 }
 
 fn parse_and_format_results(benchmark_output: &str, mem_start_end: Option<(u64, u64)>) -> String {
@@ -774,6 +1140,7 @@ This benchmark suite measures the performance of FHIRPath-rs library across thre
 
 ## Environment
 - Tool: fhirpath-bench v{}
+- Engine: octofhir-fhirpath v{}
 - OS/Arch: {} / {}
 - CPU cores: {}
 - FHIR Schema: R5
@@ -834,9 +1201,16 @@ To generate updated results:
 ```bash
 fhirpath-bench benchmark --run --output benchmark.md
 ```
+
+To check for regressions against saved results:
+```bash
+fhirpath-bench benchmark --run --json baseline.json
+fhirpath-bench benchmark --run --baseline baseline.json --threshold 10
+```
 "#,
         chrono::Utc::now().format("%Y-%m-%d %H:%M:%S UTC"),
         tool_ver,
+        octofhir_fhirpath::VERSION,
         os,
         arch,
         cores,
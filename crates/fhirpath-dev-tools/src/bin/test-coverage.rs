@@ -17,16 +17,24 @@
 //! This binary runs all official FHIRPath test suites and generates a comprehensive
 //! coverage report saved to TEST_COVERAGE.md
 
-use anyhow::Result;
+use anyhow::{Context, Result};
 use chrono::{DateTime, Utc};
 use clap::{Arg, Command};
+use fhirpath_dev_tools::report::check_writable;
+use fhirpath_dev_tools::test_support::test_clock;
 use std::fs;
 use std::path::{Path, PathBuf};
 
 // Integration test runner functionality
 mod integration_test_runner {
+    use chrono::{DateTime, Utc};
+    use fhirpath_dev_tools::fhir_xml::{
+        ensure_supported_resource_type, is_xml_input, parse_input_bytes,
+    };
     use fhirpath_dev_tools::test_support::{
-        TestCase, TestSuite, TypeMismatch, compare_results, verify_output_types,
+        TYPED_INPUT_FOCUS, TestCase, TestSuite, TypeMismatch, compare_results,
+        compare_results_unordered, environment_variables, focus_context, parse_instant,
+        resource_variables, result_to_json, verify_output_types,
     };
     use octofhir_fhir_model::FhirVersion;
     use octofhir_fhirpath::FhirPathValue;
@@ -84,6 +92,8 @@ mod integration_test_runner {
         input_cache: HashMap<String, Value>,
         base_path: PathBuf,
         verbose: bool,
+        /// Instant `now()` observes in tests without a `fixedNow`
+        now: DateTime<Utc>,
     }
 
     impl IntegrationTestRunner {
@@ -142,9 +152,16 @@ mod integration_test_runner {
                 input_cache: HashMap::new(),
                 base_path: PathBuf::from("."),
                 verbose: false,
+                now: Utc::now(),
             }
         }
 
+        /// Pin `now()`, `today()` and `timeOfDay()` for tests without a `fixedNow`
+        pub fn with_now(mut self, now: DateTime<Utc>) -> Self {
+            self.now = now;
+            self
+        }
+
         /// Set the base path for resolving test and input files
         pub fn with_base_path<P: AsRef<Path>>(mut self, path: P) -> Self {
             self.base_path = path.as_ref().to_path_buf();
@@ -195,7 +212,7 @@ mod integration_test_runner {
             let mut used_path = None;
 
             for path in &possible_paths {
-                if let Ok(file_content) = fs::read_to_string(path) {
+                if let Ok(file_content) = fs::read(path) {
                     content = Some(file_content);
                     used_path = Some(path.clone());
                     break;
@@ -214,8 +231,7 @@ mod integration_test_runner {
                 )
             })?;
 
-            let json_value: Value = serde_json::from_str(&content)
-                .map_err(|e| format!("Failed to parse JSON in {filename}: {e}"))?;
+            let json_value = parse_input_bytes(filename, &content)?;
 
             if self.verbose {
                 println!(
@@ -310,17 +326,40 @@ mod integration_test_runner {
             }
 
             // Load input data - use same logic as test-runner.rs
-            let input_data = if let Some(ref filename) = test.inputfile {
+            let typed_input = test.typed_input();
+            let input_data = if let Some(typed_input) = &typed_input {
+                match typed_input {
+                    Ok(resource) => resource.clone(),
+                    Err(error) => {
+                        return TestResult::Error {
+                            error: error.clone(),
+                        };
+                    }
+                }
+            } else if let Some(ref input_val) = test.input {
+                input_val.clone()
+            } else if let Some(ref filename) = test.inputfile {
                 match self.load_input_data(filename) {
-                    Ok(json_data) => json_data,
+                    Ok(json_data) => {
+                        if is_xml_input(filename)
+                            && let Err(e) = ensure_supported_resource_type(
+                                &json_data,
+                                self.model_provider.as_ref(),
+                            )
+                            .await
+                        {
+                            return TestResult::Error {
+                                error: format!("Failed to load input from {filename}: {e}"),
+                            };
+                        }
+                        json_data
+                    }
                     Err(e) => {
                         return TestResult::Error {
                             error: format!("Failed to load input from {filename}: {e}"),
                         };
                     }
                 }
-            } else if let Some(ref input_val) = test.input {
-                input_val.clone()
             } else {
                 serde_json::Value::Null
             };
@@ -468,6 +507,7 @@ mod integration_test_runner {
 
             // Convert input_data to FhirPathValue and create context - same as test-runner
             let input_value = octofhir_fhirpath::FhirPathValue::resource(input_data);
+            let root_variables = resource_variables(&input_value);
             let input_collection = octofhir_fhirpath::Collection::single(input_value);
             let context = octofhir_fhirpath::EvaluationContext::new(
                 input_collection,
@@ -476,12 +516,52 @@ mod integration_test_runner {
                 self.engine.get_validation_provider(),
                 self.engine.get_trace_provider(),
             );
+            for (name, value) in root_variables {
+                context.set_variable(name, value);
+            }
+            for (name, value) in environment_variables(&test.environment) {
+                context.set_variable(name, value);
+            }
+            let context = match test.fixed_now.as_deref().map(parse_instant) {
+                Some(Ok(now)) => context.with_fixed_now(now),
+                Some(Err(e)) => {
+                    return TestResult::Error {
+                        error: format!("Invalid fixedNow {e}"),
+                    };
+                }
+                None => context.with_fixed_now(self.now),
+            };
+            let context = match &typed_input {
+                Some(_) => match focus_context(&self.engine, &context, TYPED_INPUT_FOCUS).await {
+                    Ok(context) => context,
+                    Err(error) => return TestResult::Error { error },
+                },
+                None => context,
+            };
+            let context = match &test.focus {
+                Some(focus) => match focus_context(&self.engine, &context, focus).await {
+                    Ok(context) => context,
+                    Err(error) => return TestResult::Error { error },
+                },
+                None => context,
+            };
 
             // Use single root evaluation method (parse + evaluate in one call) - same as test-runner
             let timeout_ms: u64 = std::env::var("FHIRPATH_TEST_TIMEOUT_MS")
                 .ok()
                 .and_then(|s| s.parse().ok())
                 .unwrap_or(10_000);
+            let timeout = std::time::Duration::from_millis(timeout_ms);
+
+            for step in test.expression.setup() {
+                let step_fut = self.engine.evaluate(step, &context);
+                let error = match tokio::time::timeout(timeout, step_fut).await {
+                    Ok(Ok(_)) => continue,
+                    Ok(Err(e)) => format!("Setup expression `{step}` failed: {e}"),
+                    Err(_) => format!("Setup expression `{step}` timed out"),
+                };
+                return TestResult::Error { error };
+            }
 
             let eval_fut = self.engine.evaluate(&test.expression, &context);
             let result =
@@ -489,9 +569,6 @@ mod integration_test_runner {
                     .await
                 {
                     Err(_) => {
-                        if test.expect_error.unwrap_or(false) {
-                            return TestResult::Passed;
-                        }
                         return TestResult::Error {
                             error: format!("Evaluation timed out after {timeout_ms}ms"),
                         };
@@ -537,7 +614,7 @@ mod integration_test_runner {
 
             if !test.output_types.is_empty()
                 && let Err(TypeMismatch { expected, actual }) =
-                    verify_output_types(&test.output_types, &result)
+                    verify_output_types(&test.output_types, &result, test.is_unordered())
             {
                 return TestResult::Failed {
                     expected: json!({"values": test.expected.clone(), "types": expected}),
@@ -557,11 +634,16 @@ mod integration_test_runner {
             }
 
             // Compare results using the entire collection (matches test-runner behavior)
-            if compare_results(&test.expected, &result) {
+            let passed = if test.is_unordered() {
+                compare_results_unordered(&test.expected, &result, &test.output_types)
+            } else {
+                compare_results(&test.expected, &result, &test.output_types)
+            };
+            if passed {
                 TestResult::Passed
             } else {
                 // Convert actual result to JSON for display
-                let actual_json = serde_json::to_value(&result).unwrap_or_default();
+                let actual_json = result_to_json(&test.expected, &result).unwrap_or_default();
 
                 TestResult::Failed {
                     expected: test.expected.clone(),
@@ -696,10 +778,14 @@ async fn main() -> Result<()> {
 
     let specs_dir = PathBuf::from(matches.get_one::<String>("specs-dir").unwrap());
     let output_file = PathBuf::from(matches.get_one::<String>("output").unwrap());
+    check_writable(&output_file)
+        .with_context(|| format!("Cannot write {}", output_file.display()))?;
 
     println!("🧪 Generating FHIRPath Test Coverage Report");
     println!("============================================");
 
+    let now = test_clock().map_err(anyhow::Error::msg)?;
+
     if !specs_dir.exists() {
         println!("❌ Specs directory not found: {}", specs_dir.display());
         return Ok(());
@@ -717,7 +803,8 @@ async fn main() -> Result<()> {
     let mut runner = IntegrationTestRunner::new()
         .await
         .with_base_path(&specs_dir)
-        .with_verbose(false);
+        .with_verbose(false)
+        .with_now(now);
 
     let mut test_results = Vec::new();
     let mut processed = 0;
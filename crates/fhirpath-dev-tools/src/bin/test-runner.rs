@@ -20,33 +20,90 @@
 //!   cargo run --bin test-runner `<test_name>`          # Run specific test case
 //!   cargo run --bin test-runner `<category>`           # Run all tests in category
 //!
+//! Options:
+//!   --filter `<pattern>`   Only run tests whose name or suite matches a substring or glob
+//!   --output `<path>`      Write a results report to this file
+//!   --format `<format>`    Report format: json (default) or junit
+//!   --failures-only        List only failed and errored tests in the results report
+//!   --canonical            Leave timestamps and times out of the JSON report and sort it by test name
+//!   --jobs `<n>`           Evaluate up to n test cases concurrently (default: number of CPUs)
+//!   --diff                 Print expected and actual results side by side for failures
+//!   --quiet                Print a progress line every 100 tests instead of each result
+//!   --no-fail              Exit with status 0 even when tests fail or error
+//!   --max-failures `<n>`   Stop the run once n tests have failed or errored
+//!   --trace                Print each expression's parsed AST and its trace() output
+//!   --compare `<mode>`     Result comparison: json (default) or native (engine equality)
+//!   --check-idempotent     Evaluate each expression twice and fail if the results differ
+//!   --stress `<n>`         Also evaluate each expression on n concurrent tasks and compare
+//!   --shuffle              Run files and tests in a random order, printing the seed
+//!   --seed `<n>`           Seed for --shuffle, to replay an earlier order
+//!   --validate             Check input files and expression syntax without evaluating
+//!   --parse-only           Parse every selected expression and report failures, then exit
+//!   --self-test            Check the result comparison against known verdicts and exit
+//!   --expr `<expression>`  Evaluate one expression against every input file and print each result
+//!   --list                 List the selected tests (name, group, input, expression) and exit
+//!   --groups-only          With --list, only list groups and their test counts
+//!   --parse-dump `<path>`  Compare each expression's parsed AST with this golden file
+//!   --update-golden        With --parse-dump, write the golden file instead of comparing
+//!   --stream `<path>`      Append each result to this file as a JSON line as it completes
+//!   --against `<path>`     Compare results with another implementation's JSON report
+//!   --divergence `<path>`  Where to write that comparison (default: divergence.json)
+//!   --feature-support `<path>`  Write pass/fail counts per function and operator used
+//!   --emit-schema `<path>` Write the JSON Schema of the JSON results report
+//!   --timeout `<seconds>`  Per-test evaluation timeout (default: 5)
+//!   --remote-cache `<dir>` Cache for input files given as http(s) URLs (default: target/remote-inputs)
+//!   --remote-timeout `<seconds>`  Download timeout for remote input files (default: 30)
+//!   --offline              Read remote input files only from the cache
+//!   --watch                Re-run the affected tests whenever a suite or input file changes
+//!   --fhir-version `<v>`   FHIR model to evaluate against: r4, r4b, r5 (default) or r6
+//!   --log-level `<level>`  Most detailed messages to show: error, warn, info (default), debug
+//!   --log-json             Write log messages as JSON lines
+//!
 //! Examples:
 //!   cargo run --bin test-runner analyzer.json
 //!   cargo run --bin test-runner analyzer
 //!   cargo run --bin test-runner testBooleanLogicAnd1
 //!   cargo run --bin test-runner boolean
+//!   cargo run --bin test-runner -- boolean --filter 'testBooleanLogicAnd*'
 
+use clap::Parser;
+use fhirpath_dev_tools::diff::side_by_side;
+use fhirpath_dev_tools::divergence::{find_divergences, load_external_results};
+use fhirpath_dev_tools::features::{expression_features, tally_features};
+use fhirpath_dev_tools::golden::{GoldenAsts, compare_golden, parse_error_entry};
+use fhirpath_dev_tools::logging::{self, LogFormat, LogLevel};
 use fhirpath_dev_tools::metadata::{TestLookupResult, TestMetadataManager};
-use fhirpath_dev_tools::test_support::{TestSuite, compare_results, verify_output_types};
+use fhirpath_dev_tools::panics::install_backtrace_hook;
+use fhirpath_dev_tools::remote::{RemoteOptions, is_remote};
+use fhirpath_dev_tools::report::{
+    MismatchKind, ReportFormat, ResultStream, SkipReason, TestCaseResult, TestReport, TestStatus,
+    check_writable, report_schema,
+};
+use fhirpath_dev_tools::runner::{
+    CaseRunner, RunnerOptions, input_files, input_path, load_suite, run_cases, select_tests,
+};
+use fhirpath_dev_tools::selftest::run_self_test;
+use fhirpath_dev_tools::shuffle::{random_seed, shuffle};
+use fhirpath_dev_tools::test_support::{
+    CompareMode, TestMode, TestSuite, ast_tree, item_types, result_items, test_clock, typed_items,
+};
+use fhirpath_dev_tools::watch::wait_for_change;
+use fhirpath_dev_tools::{fhir_version_name, parse_fhir_version};
+use futures::StreamExt;
+use log::{error, info, warn};
 use octofhir_fhir_model::FhirVersion;
-use octofhir_fhirpath::core::trace::create_cli_provider;
-use octofhir_fhirschema::create_validation_provider_from_embedded;
 use serde_json::Value;
+use std::collections::{BTreeMap, BTreeSet};
 use std::env;
 use std::fs;
+use std::io::IsTerminal;
 use std::path::{Path, PathBuf};
 use std::process;
 use std::sync::Arc;
-use std::time::Duration;
-
-fn load_input_data(inputfile: &str) -> Result<Value, Box<dyn std::error::Error>> {
-    let specs_dir = Path::new("test-cases/input");
-    let input_path = specs_dir.join(inputfile);
+use std::time::{Duration, Instant};
 
-    let content = fs::read_to_string(&input_path)?;
-    let data: Value = serde_json::from_str(&content)?;
-    Ok(data)
-}
+/// Tests between progress lines in `--quiet` mode
+const PROGRESS_INTERVAL: usize = 100;
 
 /// Compare expected result with actual result
 /// Simplified comparison with proper handling of FHIRPath collection semantics
@@ -73,25 +130,25 @@ fn resolve_test_query(query: &str) -> TestQueryResult {
         TestLookupResult::TestCase(path, test_name) => Ok(vec![(path, Some(test_name))]),
         TestLookupResult::Category(paths) => Ok(paths.into_iter().map(|p| (p, None)).collect()),
         TestLookupResult::MultipleMatches(matches) => {
-            eprintln!("❌ Multiple matches found for '{query}':");
+            error!("❌ Multiple matches found for '{query}':");
             for m in &matches {
-                eprintln!("  • {m}");
+                error!("  • {m}");
             }
-            eprintln!("\nPlease be more specific.");
+            error!("\nPlease be more specific.");
             process::exit(1);
         }
         TestLookupResult::NotFound => {
-            eprintln!("❌ No test found for '{query}'");
-            eprintln!("\n🔍 Available options:");
+            error!("❌ No test found for '{query}'");
+            error!("\n🔍 Available options:");
 
-            eprintln!("\nCategories:");
+            error!("\nCategories:");
             for (category, count) in metadata_manager.list_categories() {
-                eprintln!("  • {category} ({count} suites)");
+                error!("  • {category} ({count} suites)");
             }
 
-            eprintln!("\nTest files:");
+            error!("\nTest files:");
             for (name, suite) in metadata_manager.list_test_files() {
-                eprintln!("  • {} ({} tests)", name, suite.test_count);
+                error!("  • {} ({} tests)", name, suite.test_count);
             }
 
             process::exit(1);
@@ -99,24 +156,588 @@ fn resolve_test_query(query: &str) -> TestQueryResult {
     }
 }
 
+/// Print the selected tests, or only their groups with test counts, without running them
+fn list_targets(
+    targets: &[(PathBuf, Option<String>)],
+    filter: Option<&str>,
+    groups_only: bool,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let mut total = 0;
+    for (path, specific_test) in targets {
+        let suite: TestSuite = serde_json::from_str(&fs::read_to_string(path)?)?;
+        let tests = select_tests(&suite, specific_test.as_deref(), filter);
+        if tests.is_empty() {
+            continue;
+        }
+        total += tests.len();
+
+        if groups_only {
+            println!("{:<40} {:>5}", suite.name, tests.len());
+            continue;
+        }
+        for test_case in tests {
+            println!(
+                "{}\t{}\t{}\t{}",
+                test_case.name,
+                suite.name,
+                test_case.inputfile.as_deref().unwrap_or("-"),
+                test_case.expression.replace('\n', " ")
+            );
+        }
+    }
+    eprintln!("{total} tests");
+    Ok(())
+}
+
+/// Check that the selected tests reference existing input files and parse, without evaluating
+///
+/// Returns every problem found rather than stopping at the first one. Expressions that
+/// a test expects to be syntax errors are not parsed.
+fn validate_targets(targets: &[(PathBuf, Option<String>)]) -> Vec<String> {
+    let mut problems = Vec::new();
+    for (path, specific_test) in targets {
+        let suite: TestSuite = match fs::read_to_string(path)
+            .map_err(|e| e.to_string())
+            .and_then(|content| serde_json::from_str(&content).map_err(|e| e.to_string()))
+        {
+            Ok(suite) => suite,
+            Err(e) => {
+                problems.push(format!("{}: failed to load: {e}", path.display()));
+                continue;
+            }
+        };
+
+        let tests = suite
+            .tests
+            .iter()
+            .filter(|t| specific_test.as_ref().is_none_or(|name| &t.name == name));
+        for test_case in tests {
+            let location = format!("{}: {}", path.display(), test_case.name);
+            if let Some(Err(e)) = test_case.typed_input() {
+                problems.push(format!("{location}: {e}"));
+            }
+            if test_case.expected_error.is_some() && test_case.expect_error != Some(true) {
+                problems.push(format!(
+                    "{location}: expectedError is set without expectError"
+                ));
+            }
+            if test_case.expect_error != Some(true)
+                && let Err(e) = test_case.check_cardinality(result_items(&test_case.expected).len())
+            {
+                problems.push(format!("{location}: expected outputs: {e}"));
+            }
+            if let Some(Err(e)) = test_case.fhir_version.as_deref().map(parse_fhir_version) {
+                problems.push(format!("{location}: fhirVersion: {e}"));
+            }
+            if let Some(max_time_ms) = test_case.max_time_ms
+                && max_time_ms <= 0.0
+            {
+                problems.push(format!(
+                    "{location}: maxTimeMs must be positive, got {max_time_ms}"
+                ));
+            }
+            if let Some(inputfile) = &test_case.inputfile
+                && test_case.input.is_none()
+                && test_case.input_value.is_none()
+                && !is_remote(inputfile)
+                && !input_path(inputfile).exists()
+            {
+                problems.push(format!(
+                    "{location}: input file {} does not exist",
+                    input_path(inputfile).display()
+                ));
+            }
+            for step in test_case.expression.setup() {
+                if let Err(e) = octofhir_fhirpath::parse_ast(step) {
+                    problems.push(format!(
+                        "{location}: setup expression `{step}` does not parse: {e}"
+                    ));
+                }
+            }
+            if test_case.invalid_kind.as_deref() != Some("syntax")
+                && let Err(e) = octofhir_fhirpath::parse_ast(&test_case.expression)
+            {
+                problems.push(format!(
+                    "{location}: expression `{}` does not parse: {e}",
+                    &*test_case.expression
+                ));
+            }
+        }
+    }
+    problems
+}
+
+/// Parse every expression of the selected tests, without loading inputs or evaluating
+///
+/// Returns the number of expressions parsed and a located description of each failure.
+/// An expression a test expects to be a syntax error fails when it parses.
+fn parse_targets(
+    targets: &[(PathBuf, Option<String>)],
+    filter: Option<&str>,
+) -> (usize, Vec<String>) {
+    let mut parsed = 0;
+    let mut failures = Vec::new();
+    for (path, specific_test) in targets {
+        let suite = match load_suite(path) {
+            Ok(suite) => suite,
+            Err(e) => {
+                failures.push(e);
+                continue;
+            }
+        };
+        for test_case in select_tests(&suite, specific_test.as_deref(), filter) {
+            let location = format!("{}: {}", path.display(), test_case.name);
+            let expects_syntax_error = test_case.invalid_kind.as_deref() == Some("syntax");
+            let steps = test_case.expression.setup().iter();
+            let expressions = steps
+                .map(|step| (step.as_str(), false))
+                .chain([(&*test_case.expression, expects_syntax_error)]);
+            for (expression, syntax_error) in expressions {
+                parsed += 1;
+                match (octofhir_fhirpath::parse_ast(expression), syntax_error) {
+                    (Ok(_), false) | (Err(_), true) => {}
+                    (Ok(_), true) => failures.push(format!(
+                        "{location}: `{expression}` parsed but is expected to be a syntax error"
+                    )),
+                    (Err(e), false) => failures.push(format!("{location}: `{expression}`: {e}")),
+                }
+            }
+        }
+    }
+    (parsed, failures)
+}
+
+/// How often watched files are checked for changes
+const WATCH_POLL: Duration = Duration::from_millis(250);
+
+/// How long watched files must stay unchanged before the tests are re-run
+const WATCH_SETTLE: Duration = Duration::from_millis(500);
+
+/// Read a suite file for watching; suites that fail to load are still watched but
+/// contribute no input files
+fn read_suite(path: &Path) -> Option<TestSuite> {
+    let content = fs::read_to_string(path).ok()?;
+    serde_json::from_str(&content).ok()
+}
+
+/// Local input files read by the selected tests, which evaluate inline or typed input
+/// instead when given
+fn target_inputs(suite: &TestSuite, specific_test: Option<&String>) -> BTreeSet<PathBuf> {
+    suite
+        .tests
+        .iter()
+        .filter(|t| specific_test.is_none_or(|name| &t.name == name))
+        .filter(|t| t.input.is_none() && t.input_value.is_none())
+        .filter_map(|t| t.inputfile.as_deref())
+        .filter(|inputfile| !is_remote(inputfile))
+        .map(input_path)
+        .collect()
+}
+
+/// Suite files of the targets and the input files their tests read
+fn watched_paths(targets: &[(PathBuf, Option<String>)]) -> Vec<PathBuf> {
+    let mut paths = BTreeSet::new();
+    for (path, specific_test) in targets {
+        paths.insert(path.clone());
+        if let Some(suite) = read_suite(path) {
+            paths.extend(target_inputs(&suite, specific_test.as_ref()));
+        }
+    }
+    paths.into_iter().collect()
+}
+
+/// Targets whose suite file changed or that read a changed input file
+fn affected_targets(
+    targets: &[(PathBuf, Option<String>)],
+    changed: &BTreeSet<PathBuf>,
+) -> Vec<(PathBuf, Option<String>)> {
+    targets
+        .iter()
+        .filter(|(path, specific_test)| {
+            changed.contains(path)
+                || read_suite(path).is_some_and(|suite| {
+                    !target_inputs(&suite, specific_test.as_ref()).is_disjoint(changed)
+                })
+        })
+        .cloned()
+        .collect()
+}
+
+/// Wait for suite and input files to change and re-run the affected tests, until the
+/// process is interrupted
+async fn watch_targets(
+    cli: &Cli,
+    runner: &Arc<CaseRunner>,
+    mut test_targets: Vec<(PathBuf, Option<String>)>,
+    jobs: usize,
+    seed: Option<u64>,
+) -> Result<(), Box<dyn std::error::Error>> {
+    loop {
+        let watched = watched_paths(&test_targets);
+        info!(
+            "\n👀 Watching {} files for changes (Ctrl-C to stop)",
+            watched.len()
+        );
+        let changed = tokio::task::spawn_blocking(move || {
+            wait_for_change(&watched, WATCH_POLL, WATCH_SETTLE)
+        })
+        .await?;
+        for path in &changed {
+            info!("✏️  Changed: {}", path.display());
+        }
+
+        // Suites may have been added or renamed, so resolve the query again
+        test_targets = match resolve_test_query(cli.query.as_deref().unwrap_or_default()) {
+            Ok(targets) => targets,
+            Err(e) => {
+                error!("❌ Failed to reload tests: {e}");
+                continue;
+            }
+        };
+        runner.forget_inputs(&changed);
+
+        let affected = affected_targets(&test_targets, &changed);
+        let rerun = if affected.is_empty() {
+            &test_targets
+        } else {
+            &affected
+        };
+        // Each re-run sees the current time, unless FHIRPATH_TEST_NOW pins it
+        match test_clock() {
+            Ok(now) => runner.set_now(now),
+            Err(e) => {
+                error!("❌ {e}");
+                continue;
+            }
+        }
+        run_targets(cli, runner, rerun, jobs, seed, Instant::now()).await?;
+    }
+}
+
+/// Parse every selected expression into a JSON AST keyed by test name
+fn dump_asts(
+    targets: &[(PathBuf, Option<String>)],
+) -> Result<GoldenAsts, Box<dyn std::error::Error>> {
+    let mut asts = GoldenAsts::new();
+    for (path, specific_test) in targets {
+        let suite: TestSuite = serde_json::from_str(&fs::read_to_string(path)?)?;
+        let tests = suite
+            .tests
+            .iter()
+            .filter(|t| specific_test.as_ref().is_none_or(|name| &t.name == name));
+        for test_case in tests {
+            let tree = match octofhir_fhirpath::parse_ast(&test_case.expression) {
+                Ok(ast) => ast_tree(&ast),
+                Err(e) => parse_error_entry(&e.to_string()),
+            };
+            asts.insert(test_case.name.clone(), tree);
+        }
+    }
+    Ok(asts)
+}
+
+/// Compare the selected expressions' ASTs with a golden file, or write it
+fn check_parse_dump(
+    targets: &[(PathBuf, Option<String>)],
+    golden_path: &Path,
+    update: bool,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let current = dump_asts(targets)?;
+    if update || !golden_path.exists() {
+        fs::write(golden_path, serde_json::to_string_pretty(&current)?)?;
+        info!(
+            "📄 Wrote {} ASTs to {}",
+            current.len(),
+            golden_path.display()
+        );
+        return Ok(());
+    }
+
+    let golden: GoldenAsts = serde_json::from_str(&fs::read_to_string(golden_path)?)?;
+    let comparison = compare_golden(&golden, &current);
+    if comparison.is_clean() {
+        info!("✅ {} ASTs match {}", current.len(), golden_path.display());
+        return Ok(());
+    }
+    for (name, differences) in &comparison.changed {
+        info!("❌ {name}");
+        for difference in differences {
+            info!("   {difference}");
+        }
+    }
+    for name in &comparison.added {
+        info!("➕ {name}: not in the golden file");
+    }
+    for name in &comparison.removed {
+        info!("➖ {name}: in the golden file but not dumped");
+    }
+    error!(
+        "\n{} changed, {} added, {} removed (rerun with --update-golden to accept)",
+        comparison.changed.len(),
+        comparison.added.len(),
+        comparison.removed.len()
+    );
+    process::exit(1);
+}
+
+fn parse_timeout(value: &str) -> Result<f64, String> {
+    match value.parse::<f64>() {
+        Ok(seconds) if seconds > 0.0 && seconds.is_finite() => Ok(seconds),
+        _ => Err(format!(
+            "invalid timeout '{value}', expected a positive number of seconds"
+        )),
+    }
+}
+
+fn parse_max_failures(value: &str) -> Result<usize, String> {
+    match value.parse::<usize>() {
+        Ok(count) if count > 0 => Ok(count),
+        _ => Err(format!(
+            "invalid failure limit '{value}', expected a positive number of tests"
+        )),
+    }
+}
+
+fn print_breakdown<K: std::fmt::Display>(counts: &BTreeMap<K, usize>) {
+    for (kind, count) in counts {
+        info!("     • {kind}: {count}");
+    }
+}
+
+#[derive(Parser)]
+#[command(name = "test-runner")]
+#[command(about = "Run FHIRPath JSON test suites by file, name, test case, or category")]
+struct Cli {
+    /// Test file, suite name, test case name, or category to run
+    #[arg(required_unless_present_any = ["expr", "self_test"])]
+    query: Option<String>,
+    /// Only run tests whose name or suite name matches this substring or glob (`*`, `?`)
+    #[arg(long)]
+    filter: Option<String>,
+    /// Write a results report to this file
+    #[arg(long)]
+    output: Option<PathBuf>,
+    /// List only failed and errored tests in the results report; its counts still cover
+    /// every test
+    #[arg(long, requires = "output")]
+    failures_only: bool,
+    /// Leave the timestamp and times out of the JSON report and sort its results by test
+    /// name, so identical results give identical files
+    #[arg(long, requires = "output")]
+    canonical: bool,
+    /// Format of the results report
+    #[arg(long, value_enum, default_value_t = ReportFormat::Json)]
+    format: ReportFormat,
+    /// Append each result to this file as a JSON line as soon as it completes
+    #[arg(long)]
+    stream: Option<PathBuf>,
+    /// Another implementation's JSON results report to compare against, joined on test name
+    #[arg(long)]
+    against: Option<PathBuf>,
+    /// Where to write the tests the two implementations disagree on
+    #[arg(long, default_value = "divergence.json", requires = "against")]
+    divergence: PathBuf,
+    /// Write pass and fail counts per function and operator used by the tests to this file
+    #[arg(long)]
+    feature_support: Option<PathBuf>,
+    /// Write the JSON Schema of the --output JSON report to this file
+    #[arg(long)]
+    emit_schema: Option<PathBuf>,
+    /// Number of test cases to evaluate concurrently (defaults to the number of CPUs)
+    #[arg(long)]
+    jobs: Option<usize>,
+    /// Print expected and actual results side by side for failed and errored tests
+    #[arg(long)]
+    diff: bool,
+    /// Leave out per-test lines and print a periodic progress line instead
+    #[arg(long, short)]
+    quiet: bool,
+    /// Always exit successfully, for informational runs that should not gate CI
+    #[arg(long)]
+    no_fail: bool,
+    /// Stop the run once this many tests have failed or errored, summarizing the tests
+    /// run so far
+    #[arg(long, value_parser = parse_max_failures)]
+    max_failures: Option<usize>,
+    /// Print the parsed AST of each expression before evaluating it, and the values it
+    /// emits through trace() after its result
+    #[arg(long)]
+    trace: bool,
+    /// How evaluated results are compared with expected outputs
+    #[arg(long, value_enum, default_value_t = CompareMode::Json)]
+    compare: CompareMode,
+    /// Evaluate each expression twice against the same input and fail when the results
+    /// differ
+    #[arg(long)]
+    check_idempotent: bool,
+    /// Evaluate each expression again on this many concurrent tasks and fail when any
+    /// result differs from the first
+    #[arg(long, default_value_t = 0)]
+    stress: usize,
+    /// Run files and tests in a random order
+    #[arg(long)]
+    shuffle: bool,
+    /// Seed for --shuffle, to replay the order of an earlier run
+    #[arg(long, requires = "shuffle")]
+    seed: Option<u64>,
+    /// Only check that input files exist and expressions parse, then exit
+    #[arg(long)]
+    validate: bool,
+    /// Only parse every selected expression, without loading inputs, and report the
+    /// ones that fail, then exit
+    #[arg(long)]
+    parse_only: bool,
+    /// Check the result comparison against pairs with known verdicts, then exit
+    #[arg(long)]
+    self_test: bool,
+    /// Evaluate this expression against every file in test-cases/input, print each
+    /// result or error, then exit
+    #[arg(long, conflicts_with = "query")]
+    expr: Option<String>,
+    /// List the selected tests with their group, input file and expression, then exit
+    #[arg(long)]
+    list: bool,
+    /// With --list, print only group names and test counts
+    #[arg(long, requires = "list")]
+    groups_only: bool,
+    /// Compare the parsed AST of each expression with this golden file, then exit; the
+    /// file is created when it does not exist
+    #[arg(long)]
+    parse_dump: Option<PathBuf>,
+    /// With --parse-dump, overwrite the golden file with the current ASTs
+    #[arg(long, requires = "parse_dump")]
+    update_golden: bool,
+    /// Seconds a single evaluation may take before the test errors (default: 5, or
+    /// FHIRPATH_TEST_TIMEOUT_MS)
+    #[arg(long, value_parser = parse_timeout)]
+    timeout: Option<f64>,
+    /// Directory where input files given as http(s) URLs are cached
+    #[arg(long, default_value = "target/remote-inputs")]
+    remote_cache: PathBuf,
+    /// Seconds a download of a remote input file may take
+    #[arg(long, default_value_t = 30.0, value_parser = parse_timeout)]
+    remote_timeout: f64,
+    /// Read remote input files only from the cache; tests whose file is not cached error
+    #[arg(long)]
+    offline: bool,
+    /// Most detailed log messages to show: error, warn, info or debug
+    #[arg(long, value_enum, default_value_t = LogLevel::Info)]
+    log_level: LogLevel,
+    /// Write log messages as JSON lines instead of text
+    #[arg(long)]
+    log_json: bool,
+    /// Keep running and re-run the affected tests whenever a suite or input file changes
+    #[arg(long)]
+    watch: bool,
+    /// FHIR version of the model the tests are evaluated against (r4, r4b, r5, r6)
+    #[arg(long, default_value = "r5", value_parser = parse_fhir_version)]
+    fhir_version: FhirVersion,
+}
+
 #[tokio::main]
 async fn main() -> Result<(), Box<dyn std::error::Error>> {
-    let args: Vec<String> = env::args().collect();
-    if args.len() != 2 {
-        eprintln!("Usage: {} <query>", args[0]);
-        eprintln!("\nExamples:");
-        eprintln!("  {} analyzer.json          # Run specific file", args[0]);
-        eprintln!("  {} analyzer               # Run by filename", args[0]);
-        eprintln!("  {} testBooleanLogicAnd1   # Run specific test", args[0]);
-        eprintln!("  {} boolean                # Run category", args[0]);
+    let cli = Cli::parse();
+    let start = Instant::now();
+    let log_format = if cli.log_json {
+        LogFormat::Json
+    } else {
+        LogFormat::Text
+    };
+    logging::init(env!("CARGO_CRATE_NAME"), cli.log_level, log_format)?;
+    install_backtrace_hook();
+    if cli.self_test {
+        let (count, failures) = run_self_test();
+        for failure in &failures {
+            error!("❌ {failure}");
+        }
+        if failures.is_empty() {
+            info!("✅ All {count} comparison self-test cases hold");
+            return Ok(());
+        }
+        error!(
+            "\n{} of {count} comparison self-test cases changed",
+            failures.len()
+        );
         process::exit(1);
     }
-
-    let query = &args[1];
+    if let Some(expression) = &cli.expr {
+        let runner = create_runner(&cli).await?;
+        return evaluate_on_inputs(&runner, expression).await;
+    }
+    let query = cli.query.as_deref().unwrap_or_default();
     let test_targets = resolve_test_query(query)?;
 
+    if cli.list {
+        return list_targets(&test_targets, cli.filter.as_deref(), cli.groups_only);
+    }
+
+    if let Some(golden_path) = &cli.parse_dump {
+        return check_parse_dump(&test_targets, golden_path, cli.update_golden);
+    }
+
+    if cli.parse_only {
+        let (parsed, failures) = parse_targets(&test_targets, cli.filter.as_deref());
+        for failure in &failures {
+            error!("❌ {failure}");
+        }
+        info!(
+            "🧩 Parsed {parsed} expressions from {} files, {} problems",
+            test_targets.len(),
+            failures.len()
+        );
+        if failures.is_empty() {
+            return Ok(());
+        }
+        process::exit(1);
+    }
+
+    if cli.validate {
+        let problems = validate_targets(&test_targets);
+        if problems.is_empty() {
+            info!("✅ {} test files are valid", test_targets.len());
+            return Ok(());
+        }
+        for problem in &problems {
+            error!("❌ {problem}");
+        }
+        error!("\n{} problems found", problems.len());
+        process::exit(1);
+    }
+
+    if cli.canonical && cli.format != ReportFormat::Json {
+        return Err("--canonical only applies to the JSON report format".into());
+    }
+
+    // Fail before the slow setup rather than after the run when a report cannot be written
+    let report_paths = [
+        cli.output.as_ref(),
+        cli.stream.as_ref(),
+        cli.against.as_ref().map(|_| &cli.divergence),
+        cli.feature_support.as_ref(),
+        cli.emit_schema.as_ref(),
+    ];
+    for path in report_paths.into_iter().flatten() {
+        check_writable(path).map_err(|e| format!("Cannot write {}: {e}", path.display()))?;
+    }
+    if let Some(path) = &cli.emit_schema {
+        fs::write(path, serde_json::to_string_pretty(&report_schema())?)?;
+        info!("📄 Wrote the report schema to {}", path.display());
+    }
+
+    // Shuffle files and the tests within each file; each file's order derives from the seed
+    let seed = cli.shuffle.then(|| cli.seed.unwrap_or_else(random_seed));
+    let test_targets = match seed {
+        Some(seed) => {
+            info!("🔀 Shuffling tests with seed {seed} (pass --seed {seed} to replay)");
+            let mut test_targets = test_targets;
+            shuffle(&mut test_targets, seed);
+            test_targets
+        }
+        None => test_targets,
+    };
+
     if test_targets.len() > 1 {
-        println!(
+        info!(
             "🧪 Running FHIRPath tests from {} files for query: {}",
             test_targets.len(),
             query
@@ -124,86 +745,149 @@ async fn main() -> Result<(), Box<dyn std::error::Error>> {
     } else {
         let (path, test_name) = &test_targets[0];
         if let Some(test_name) = test_name {
-            println!(
+            info!(
                 "🧪 Running specific test '{}' from: {}",
                 test_name,
                 path.display()
             );
         } else {
-            println!("🧪 Running FHIRPath tests from: {}", path.display());
+            info!("🧪 Running FHIRPath tests from: {}", path.display());
         }
     }
 
     // Initialize shared components once
-    println!("📋 Initializing FHIR R5 schema provider...");
-    let _provider_timeout = Duration::from_secs(60);
-    let provider = octofhir_fhirschema::EmbeddedSchemaProvider::new(FhirVersion::R5);
-    println!("✅ EmbeddedModelProvider (R5) loaded successfully");
-    let model_provider: Arc<dyn octofhir_fhirpath::ModelProvider> = Arc::new(provider);
-
-    // Create function registry
-    println!("📋 Creating function registry...");
-    let registry_start = std::time::Instant::now();
-    let registry = std::sync::Arc::new(octofhir_fhirpath::create_function_registry());
-    let registry_time = registry_start.elapsed();
-    println!(
-        "✅ Function registry created in {}ms",
-        registry_time.as_millis()
-    );
-
-    // Create the FhirPathEngine with model provider
-    println!("📋 Creating FhirPathEngine...");
-    let engine_start = std::time::Instant::now();
-    let provider_version = model_provider
-        .get_fhir_version()
-        .await
-        .unwrap_or(octofhir_fhirschema::ModelFhirVersion::R4);
-    let fhir_version = match provider_version {
-        octofhir_fhirschema::ModelFhirVersion::R4 => "r4".to_string(),
-        octofhir_fhirschema::ModelFhirVersion::R4B => "r4b".to_string(),
-        octofhir_fhirschema::ModelFhirVersion::R5 => "r5".to_string(),
-        octofhir_fhirschema::ModelFhirVersion::R6 => "r6".to_string(),
-        _ => "r4".to_string(),
-    };
-    let mut engine =
-        octofhir_fhirpath::FhirPathEngine::new(registry, model_provider.clone()).await?;
-
-    // Add CLI trace provider for trace function support
-    let trace_provider = create_cli_provider();
-    engine = engine.with_trace_provider(trace_provider);
+    let runner = create_runner(&cli).await?;
+    let jobs = cli
+        .jobs
+        .unwrap_or_else(|| {
+            std::thread::available_parallelism()
+                .map(|n| n.get())
+                .unwrap_or(1)
+        })
+        .max(1);
 
-    if let Ok(validation_provider) = create_validation_provider_from_embedded(
-        model_provider.clone() as Arc<dyn octofhir_fhir_model::provider::ModelProvider>,
-    )
-    .await
-    {
-        engine = engine.with_validation_provider(validation_provider);
+    let all_passed = run_targets(&cli, &runner, &test_targets, jobs, seed, start).await?;
+    if cli.watch {
+        return watch_targets(&cli, &runner, test_targets, jobs, seed).await;
+    }
+    if !all_passed && !cli.no_fail {
+        process::exit(1);
     }
+    Ok(())
+}
 
-    // Attach HttpTerminologyProvider (tx.fhir.org) for terminology-enabled tests
-    let tx_base = match fhir_version.as_str() {
-        "r6" => "https://tx.fhir.org/r6",
-        "r5" => "https://tx.fhir.org/r5",
-        "r4b" => "https://tx.fhir.org/r4b",
-        _ => "https://tx.fhir.org/r4",
+/// Create the engine and the runner shared by every test, with `now()` pinned to the
+/// clock of the run (see [`test_clock`])
+async fn create_runner(cli: &Cli) -> Result<Arc<CaseRunner>, Box<dyn std::error::Error>> {
+    let now = test_clock()?;
+    info!(
+        "🕒 now() pinned to {} (set FHIRPATH_TEST_NOW to replay)",
+        now.to_rfc3339()
+    );
+    let timeout = match cli.timeout {
+        Some(seconds) => Duration::from_secs_f64(seconds),
+        None => Duration::from_millis(
+            env::var("FHIRPATH_TEST_TIMEOUT_MS")
+                .ok()
+                .and_then(|s| s.parse().ok())
+                .unwrap_or(5_000),
+        ),
     };
-    if let Ok(tx) = octofhir_fhir_model::HttpTerminologyProvider::new(tx_base.to_string()) {
-        let tx_arc: std::sync::Arc<dyn octofhir_fhir_model::terminology::TerminologyProvider> =
-            std::sync::Arc::new(tx);
-        engine = engine.with_terminology_provider(tx_arc.clone());
+    info!(
+        "📋 Creating FhirPathEngine for FHIR {}...",
+        fhir_version_name(cli.fhir_version).to_uppercase()
+    );
+    let engine_start = Instant::now();
+    let runner = Arc::new(
+        CaseRunner::new(RunnerOptions {
+            fhir_version: cli.fhir_version,
+            trace: cli.trace,
+            compare: cli.compare,
+            timeout,
+            check_idempotent: cli.check_idempotent,
+            stress: cli.stress,
+            remote: RemoteOptions {
+                cache_dir: cli.remote_cache.clone(),
+                timeout: Duration::from_secs_f64(cli.remote_timeout),
+                offline: cli.offline,
+            },
+            now,
+        })
+        .await?,
+    );
+    info!(
+        "✅ FhirPathEngine created in {}ms",
+        engine_start.elapsed().as_millis()
+    );
+    Ok(runner)
+}
+
+/// Evaluate one expression against every input file and print each result or error;
+/// exits with status 1 when any evaluation errors
+async fn evaluate_on_inputs(
+    runner: &CaseRunner,
+    expression: &str,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let files = input_files()?;
+    info!(
+        "🧪 Evaluating '{expression}' against {} input files",
+        files.len()
+    );
+    let mut errors = 0;
+    for file in &files {
+        match runner.evaluate_on_input(expression, file).await {
+            Ok(result) => info!("✅ {file}: {result}"),
+            Err(e) => {
+                errors += 1;
+                error!("❌ {file}: {e}");
+            }
+        }
+    }
+    info!("\n📊 {} evaluated, {errors} errored", files.len() - errors);
+    if errors > 0 {
+        process::exit(1);
     }
-    let engine_time = engine_start.elapsed();
-    println!("✅ FhirPathEngine created in {}ms", engine_time.as_millis());
+    Ok(())
+}
+
+/// Run the targets and print their summaries and reports; returns whether every test
+/// passed
+async fn run_targets(
+    cli: &Cli,
+    runner: &Arc<CaseRunner>,
+    test_targets: &[(PathBuf, Option<String>)],
+    jobs: usize,
+    seed: Option<u64>,
+    start: Instant,
+) -> Result<bool, Box<dyn std::error::Error>> {
+    let use_color = std::io::stdout().is_terminal();
 
     // Process all test targets
     let mut total_passed = 0;
     let mut total_failed = 0;
     let mut total_errors = 0;
     let mut total_tests = 0;
+    let mut total_invalid = 0;
+    let mut passed_so_far = 0;
+    let mut run_time = Duration::ZERO;
+    let run_start = Instant::now();
+    let mut total_skipped = 0;
+    let mut total_skips: BTreeMap<SkipReason, usize> = BTreeMap::new();
+    let mut total_mismatches: BTreeMap<MismatchKind, usize> = BTreeMap::new();
+    let mut warned_unknown_mode = false;
+    let mut truncated = false;
+    let mut results: Vec<TestCaseResult> = Vec::new();
+    let mut test_features: Vec<(BTreeSet<String>, TestStatus)> = Vec::new();
+    let mut stream = match &cli.stream {
+        Some(path) => Some(ResultStream::new(std::io::BufWriter::new(
+            fs::File::create(path)?,
+        ))),
+        None => None,
+    };
 
     for (i, (test_file_path, specific_test)) in test_targets.iter().enumerate() {
         if test_targets.len() > 1 {
-            println!(
+            info!(
                 "\n📁 ({}/{}) Processing: {}",
                 i + 1,
                 test_targets.len(),
@@ -211,409 +895,331 @@ async fn main() -> Result<(), Box<dyn std::error::Error>> {
             );
         }
 
-        // Load test suite
-        let content = match fs::read_to_string(test_file_path) {
-            Ok(content) => content,
-            Err(e) => {
-                eprintln!("❌ Failed to read test file: {e}");
-                continue;
-            }
-        };
-
-        let test_suite: TestSuite = match serde_json::from_str(&content) {
+        let test_suite = match load_suite(test_file_path) {
             Ok(suite) => suite,
             Err(e) => {
-                eprintln!("❌ Failed to parse test file: {e}");
+                error!("❌ {e}");
                 continue;
             }
         };
 
-        println!("📝 Test Suite: {}", test_suite.name);
+        info!("📝 Test Suite: {}", test_suite.name);
         if let Some(desc) = &test_suite.description {
-            println!("📋 Description: {desc}");
+            info!("📋 Description: {desc}");
         }
 
-        // Filter tests if specific test requested
-        let tests_to_run: Vec<_> = if let Some(specific_test_name) = specific_test {
-            test_suite
-                .tests
-                .iter()
-                .filter(|t| &t.name == specific_test_name)
-                .collect()
-        } else {
-            test_suite.tests.iter().collect()
-        };
+        let specific_test = specific_test.as_deref();
+        let mut tests_to_run = select_tests(&test_suite, specific_test, cli.filter.as_deref());
+        if let Some(pattern) = &cli.filter {
+            let before = select_tests(&test_suite, specific_test, None).len();
+            info!(
+                "🔎 Filter '{pattern}' matched {} tests, skipped {}",
+                tests_to_run.len(),
+                before - tests_to_run.len()
+            );
+        }
+        if let Some(seed) = seed {
+            shuffle(&mut tests_to_run, seed.wrapping_add(i as u64));
+        }
 
         if tests_to_run.is_empty() {
-            if specific_test.is_some() {
-                eprintln!(
-                    "❌ Test '{}' not found in suite '{}'",
-                    specific_test.as_ref().unwrap(),
+            if let Some(specific_test) = specific_test {
+                error!(
+                    "❌ Test '{specific_test}' not found in suite '{}'",
                     test_suite.name
                 );
             } else {
-                println!("⚠️  No tests found in suite '{}'", test_suite.name);
+                warn!("⚠️  No tests found in suite '{}'", test_suite.name);
             }
             continue;
         }
 
-        println!(
+        info!(
             "🔢 Running {} of {} tests",
             tests_to_run.len(),
             test_suite.tests.len()
         );
-        println!();
+        info!("");
 
         let mut passed = 0;
         let mut failed = 0;
         let mut errors = 0;
+        let mut skipped = 0;
+        let mut invalid = 0;
+        let mut suite_skips: BTreeMap<SkipReason, usize> = BTreeMap::new();
+        let mut suite_mismatches: BTreeMap<MismatchKind, usize> = BTreeMap::new();
 
-        'test_loop: for test_case in &tests_to_run {
-            print!("Running {} ... ", test_case.name);
+        for test_case in &tests_to_run {
+            if test_case.invalid_kind.is_some() {
+                invalid += 1;
+            }
+            if let Err(unknown) = TestMode::parse(test_case.mode.as_deref())
+                && !warned_unknown_mode
+            {
+                warn!("⚠️  Unknown test mode '{unknown}', treating as lenient");
+                warned_unknown_mode = true;
+            }
+        }
 
-            // (Debug block removed; keeping runner output lean for CI)
+        let suite_start = Instant::now();
+        let mut outcomes = run_cases(runner, &test_suite, &tests_to_run, jobs);
 
-            // Load input data
-            let input_data = if let Some(ref inputfile) = test_case.inputfile {
-                match load_input_data(inputfile) {
-                    Ok(data) => data,
-                    Err(e) => {
-                        println!("⚠️ ERROR: Failed to load input file {inputfile}: {e}");
-                        errors += 1;
-                        continue;
-                    }
-                }
-            } else if let Some(ref input) = test_case.input {
-                input.clone()
-            } else {
-                Value::Null
+        for test_case in &tests_to_run {
+            let Some(outcome) = outcomes.next().await else {
+                break;
             };
-
-            // Check if this is an analyzer category test - run analyzer-only execution
-            if test_case.category.as_ref().is_some_and(|c| c == "analyzer")
-                || test_suite
-                    .category
-                    .as_ref()
-                    .is_some_and(|c| c == "analyzer")
-            {
-                // For analyzer tests, only run semantic analysis
-                let context_type = if input_data != Value::Null {
-                    // Try to determine FHIR resource type from input
-                    if let Some(resource_type) =
-                        input_data.get("resourceType").and_then(|v| v.as_str())
-                    {
-                        model_provider.get_type(resource_type).await.ok().flatten()
-                    } else {
-                        None
-                    }
-                } else {
-                    None
-                };
-
-                let semantic_result = octofhir_fhirpath::parser::parse_with_semantic_analysis(
-                    &test_case.expression,
-                    model_provider.clone(),
-                    context_type,
-                )
-                .await;
-
-                if test_case.expect_error.unwrap_or(false) {
-                    if let Some(ref invalid_kind) = test_case.invalid_kind
-                        && (invalid_kind == "semantic" || invalid_kind == "syntax")
-                    {
-                        // Expect semantic/syntax error
-                        if !semantic_result.analysis.success {
-                            // Found error as expected
-                            for diagnostic in &semantic_result.analysis.diagnostics {
-                                if matches!(
-                                    diagnostic.severity,
-                                    octofhir_fhirpath::diagnostics::DiagnosticSeverity::Error
-                                ) {
-                                    println!(
-                                        "✅ PASS: {} error detected: {}",
-                                        invalid_kind, diagnostic.message
-                                    );
-                                    passed += 1;
-                                    continue 'test_loop;
-                                }
-                            }
-                        }
-                        // No error found when expected
-                        println!("❌ FAIL: Expected {invalid_kind} error but none found");
-                        failed += 1;
-                        continue;
-                    }
-                } else {
-                    // Expect successful analysis - but continue with full evaluation if semantic analysis passes
-                    if !semantic_result.analysis.success {
-                        // Check if this is a type resolution issue that might work with full evaluation
-                        let has_type_resolution_error = semantic_result
-                            .analysis
-                            .diagnostics
-                            .iter()
-                            .any(|d| d.message.contains("not found on Any"));
-
-                        // If test has expected results and the error is just type resolution, fall through to evaluation
-                        if has_type_resolution_error
-                            && (test_case.expected != Value::Null
-                                || !test_case.output_types.is_empty())
-                        {
-                            println!(
-                                "⚠️  Semantic analysis failed due to type resolution, trying full evaluation..."
-                            );
-                            // Fall through to evaluation
-                        } else {
-                            println!("❌ FAIL: Unexpected semantic errors:");
-                            for diagnostic in &semantic_result.analysis.diagnostics {
-                                if matches!(
-                                    diagnostic.severity,
-                                    octofhir_fhirpath::diagnostics::DiagnosticSeverity::Error
-                                ) {
-                                    println!("   - {}", diagnostic.message);
-                                }
-                            }
-                            failed += 1;
-                            continue;
-                        }
-                    }
-                    // Semantic analysis passed OR we're falling through due to type resolution issues - continue to evaluation
+            if !cli.quiet {
+                info!("{}", outcome.output.trim_end());
+            }
+            if !cli.quiet && cli.trace {
+                for trace in &outcome.traces {
+                    info!(
+                        "   TRACE[{}][{}]: {}",
+                        trace.label, trace.index, trace.value
+                    );
                 }
             }
-
-            // For non-analyzer tests, check for semantic errors first if test expects an error
-            if test_case.expect_error.is_some()
-                && test_case.expect_error.unwrap()
-                && let Some(ref invalid_kind) = test_case.invalid_kind
-                && invalid_kind == "semantic"
+            if !cli.quiet
+                && cli.diff
+                && matches!(outcome.status, TestStatus::Failed | TestStatus::Error)
             {
-                // Extract context type from input data if available
-                let context_type = if input_data != Value::Null {
-                    // Try to determine FHIR resource type from input
-                    if let Some(resource_type) =
-                        input_data.get("resourceType").and_then(|v| v.as_str())
-                    {
-                        model_provider.get_type(resource_type).await.ok().flatten()
-                    } else {
-                        None
-                    }
+                let actual = outcome
+                    .actual
+                    .clone()
+                    .unwrap_or_else(|| Value::String(outcome.message.clone().unwrap_or_default()));
+                // Without declared output types, only the values of matching rows can differ
+                let expected_types = if test_case.output_types.is_empty() {
+                    item_types(&actual)
                 } else {
-                    None
+                    test_case.output_types.clone()
                 };
-
-                let semantic_result = octofhir_fhirpath::parser::parse_with_semantic_analysis(
-                    &test_case.expression,
-                    model_provider.clone(),
-                    context_type,
-                )
-                .await;
-
-                if !semantic_result.analysis.success {
-                    // Found semantic error as expected
-                    for diagnostic in &semantic_result.analysis.diagnostics {
-                        if matches!(
-                            diagnostic.severity,
-                            octofhir_fhirpath::diagnostics::DiagnosticSeverity::Error
-                        ) {
-                            println!("✅ PASS: Semantic error detected: {}", diagnostic.message);
-                            passed += 1;
-                            continue 'test_loop;
-                        }
-                    }
-                }
-                // If we get here, no semantic error was found
-                println!("❌ FAIL: Expected semantic error but none found");
-                failed += 1;
-                continue;
+                let expected = typed_items(&test_case.expected, &expected_types);
+                info!("{}", side_by_side(&expected, &actual, use_color));
             }
 
-            // Convert input to FhirPathValue and create evaluation context
-            let input_value = octofhir_fhirpath::FhirPathValue::resource(input_data);
-            let input_collection = octofhir_fhirpath::Collection::single(input_value);
-            let context = octofhir_fhirpath::EvaluationContext::new(
-                input_collection,
-                model_provider.clone(),
-                engine.get_terminology_provider(),
-                engine.get_validation_provider(),
-                engine.get_trace_provider(),
-            );
-
-            // Log terminology setup only for tests that actually use it (engine handles terminology setup automatically)
-            if test_suite.name.contains("Terminology")
-                || test_case.expression.contains("%terminologies")
-            {
-                let fhir_version =
-                    std::env::var("FHIRPATH_FHIR_VERSION").unwrap_or_else(|_| "r4".to_string());
-                println!(
-                    "📋 Engine includes terminology service (tx.fhir.org/{fhir_version}) for test '{}'",
-                    test_case.name
-                );
+            let outcome_passed = outcome.status == TestStatus::Passed;
+            match outcome.status {
+                TestStatus::Passed => passed += 1,
+                TestStatus::Failed => failed += 1,
+                TestStatus::Error => errors += 1,
+                TestStatus::Skipped => skipped += 1,
             }
-
-            // Use single root evaluation method (parse + evaluate in one call)
-            let timeout_ms: u64 = env::var("FHIRPATH_TEST_TIMEOUT_MS")
-                .ok()
-                .and_then(|s| s.parse().ok())
-                .unwrap_or(5_000);
-
-            println!("📋 Evaluating expression with timeout {timeout_ms}ms...");
-            let eval_start = std::time::Instant::now();
-            let eval_fut = engine.evaluate(&test_case.expression, &context);
-            let result = match tokio::time::timeout(Duration::from_millis(timeout_ms), eval_fut)
-                .await
-            {
-                Err(_) => {
-                    let eval_time = eval_start.elapsed();
-                    println!(
-                        "⚠️ TIMEOUT after {}ms (limit: {timeout_ms}ms)",
-                        eval_time.as_millis()
-                    );
-                    if test_case.expect_error.is_some() && test_case.expect_error.unwrap() {
-                        println!("✅ PASS");
-                        passed += 1;
-                        continue;
-                    }
-                    errors += 1;
-                    continue;
-                }
-                Ok(inner) => {
-                    let eval_time = eval_start.elapsed();
-                    println!("✅ Expression evaluated in {}ms", eval_time.as_millis());
-                    match inner {
-                        Ok(eval_result) => eval_result.value, // Extract FhirPathValue from EvaluationResult
-                        Err(e) => {
-                            if test_case.expect_error.is_some() && test_case.expect_error.unwrap() {
-                                println!("✅ PASS");
-                                passed += 1;
-                                continue;
-                            }
-                            println!("⚠️ ERROR: {e}");
-                            errors += 1;
-                            continue;
-                        }
-                    }
-                }
-            };
-
-            // Check if test expects an error but we got a result
-            if test_case.expect_error.is_some() && test_case.expect_error.unwrap() {
-                println!("❌ FAIL: Expected error but got result");
-                failed += 1;
-                continue;
+            if let Some(reason) = outcome.skip_reason {
+                *suite_skips.entry(reason).or_insert(0) += 1;
             }
-
-            // Handle predicate tests - convert result to boolean using FHIRPath exists() logic
-            let final_result = if test_case.predicate.is_some() && test_case.predicate.unwrap() {
-                use octofhir_fhirpath::FhirPathValue;
-                let exists = !result.is_empty();
-                octofhir_fhirpath::Collection::single(FhirPathValue::Boolean(
-                    exists,
-                    octofhir_fhir_model::type_constants::BOOLEAN_TYPE.clone(),
-                    None,
-                ))
-            } else {
-                result
-            };
-
-            if !test_case.output_types.is_empty()
-                && let Err(mismatch) = verify_output_types(&test_case.output_types, &final_result)
+            if let Some(kind) = outcome.mismatch {
+                *suite_mismatches.entry(kind).or_insert(0) += 1;
+            }
+            if cli.feature_support.is_some() {
+                let steps = test_case.expression.setup().iter().map(String::as_str);
+                let features = steps
+                    .chain([&*test_case.expression])
+                    .flat_map(expression_features)
+                    .collect();
+                test_features.push((features, outcome.status));
+            }
+            let result = outcome.into_result(&test_suite.name, test_case);
+            if let Some(stream) = &mut stream
+                && let Err(e) = stream.push(&result)
             {
-                println!("❌ FAIL: Type mismatch");
-                println!("   Expected types: {:?}", mismatch.expected);
-                println!("   Actual types:   {:?}", mismatch.actual);
-                failed += 1;
-                continue;
+                warn!("⚠️  Failed to stream result: {e}");
             }
+            results.push(result);
 
-            // Compare results
-            if compare_results(&test_case.expected, &final_result) {
-                println!("✅ PASS");
-                passed += 1;
-            } else {
-                println!("❌ FAIL");
-                println!("   Expression: {}", test_case.expression);
-                if let Some(inputfile) = &test_case.inputfile {
-                    println!("   Input file: {inputfile}");
-                }
-                let expected_json =
-                    serde_json::to_string_pretty(&test_case.expected).unwrap_or_default();
-                let actual_json = match serde_json::to_value(&final_result) {
-                    Ok(json) => serde_json::to_string_pretty(&json)
-                        .unwrap_or_else(|_| format!("{final_result:?}")),
-                    Err(_) => format!("{final_result:?}"),
-                };
-                println!("   Expected: {expected_json}");
-                println!("   Actual:   {actual_json}");
-
-                println!();
-                failed += 1;
+            if outcome_passed {
+                passed_so_far += 1;
+            }
+            if cli.quiet && results.len().is_multiple_of(PROGRESS_INTERVAL) {
+                info!(
+                    "⏳ {} tests done, {:.1}% passing, {:.1}s elapsed",
+                    results.len(),
+                    passed_so_far as f64 / results.len() as f64 * 100.0,
+                    run_start.elapsed().as_secs_f64()
+                );
+            }
+            if cli
+                .max_failures
+                .is_some_and(|max| total_failed + total_errors + failed + errors >= max)
+            {
+                truncated = true;
+                break;
             }
         }
+        // Aborts the cases still running when the run stopped early
+        drop(outcomes);
 
-        println!();
-        println!("📊 === Test Suite Summary ===");
-        println!("Total:   {}", tests_to_run.len());
+        run_time += suite_start.elapsed();
+        // Fewer than selected when the run stopped at --max-failures
+        let ran = passed + failed + errors + skipped;
+
+        info!("");
+        info!("📊 === Test Suite Summary ===");
+        info!("Total:   {ran}");
         if passed > 0 {
-            println!(
+            info!(
                 "✅ Passed:  {} ({:.1}%)",
                 passed,
-                (passed as f64 / tests_to_run.len() as f64) * 100.0
+                (passed as f64 / ran as f64) * 100.0
             );
         }
         if failed > 0 {
-            println!(
+            info!(
                 "❌ Failed:  {} ({:.1}%)",
                 failed,
-                (failed as f64 / tests_to_run.len() as f64) * 100.0
+                (failed as f64 / ran as f64) * 100.0
             );
+            print_breakdown(&suite_mismatches);
         }
         if errors > 0 {
-            println!(
+            info!(
                 "⚠️  Errors:  {} ({:.1}%)",
                 errors,
-                (errors as f64 / tests_to_run.len() as f64) * 100.0
+                (errors as f64 / ran as f64) * 100.0
             );
         }
 
+        if skipped > 0 {
+            info!("⏭️  Skipped: {skipped}");
+            print_breakdown(&suite_skips);
+        }
+
+        if invalid > 0 {
+            info!("🚫 Invalid: {invalid} (expressions expected to be rejected)");
+        }
+
         total_passed += passed;
         total_failed += failed;
         total_errors += errors;
-        total_tests += tests_to_run.len();
+        total_invalid += invalid;
+        total_skipped += skipped;
+        for (reason, count) in suite_skips {
+            *total_skips.entry(reason).or_insert(0) += count;
+        }
+        for (kind, count) in suite_mismatches {
+            *total_mismatches.entry(kind).or_insert(0) += count;
+        }
+        total_tests += ran;
+        if truncated {
+            break;
+        }
     }
 
     // Overall summary for multiple files
     if test_targets.len() > 1 {
-        println!("\n📊 === Overall Summary ===");
-        println!("Total files: {}", test_targets.len());
-        println!("Total tests: {total_tests}");
+        info!("\n📊 === Overall Summary ===");
+        info!("Total files: {}", test_targets.len());
+        info!("Total tests: {total_tests}");
         if total_passed > 0 {
-            println!(
+            info!(
                 "✅ Passed:   {} ({:.1}%)",
                 total_passed,
                 (total_passed as f64 / total_tests as f64) * 100.0
             );
         }
         if total_failed > 0 {
-            println!(
+            info!(
                 "❌ Failed:   {} ({:.1}%)",
                 total_failed,
                 (total_failed as f64 / total_tests as f64) * 100.0
             );
+            print_breakdown(&total_mismatches);
         }
         if total_errors > 0 {
-            println!(
+            info!(
                 "⚠️  Errors:   {} ({:.1}%)",
                 total_errors,
                 (total_errors as f64 / total_tests as f64) * 100.0
             );
         }
+        if total_skipped > 0 {
+            info!("⏭️  Skipped:  {total_skipped}");
+            print_breakdown(&total_skips);
+        }
+        if total_invalid > 0 {
+            info!("🚫 Invalid:  {total_invalid} (expressions expected to be rejected)");
+        }
     }
 
-    if total_failed > 0 || total_errors > 0 {
-        println!("💥 Some tests failed or errored.");
-        process::exit(1);
+    if let Some(max) = cli.max_failures
+        && truncated
+    {
+        warn!(
+            "\n⛔ Run stopped after {max} failed or errored tests; only {} of the selected tests ran",
+            results.len()
+        );
+    }
+
+    if let Some(stream) = stream {
+        stream.finish()?;
+        if let Some(path) = &cli.stream {
+            info!("📄 Streamed results to {}", path.display());
+        }
+    }
+
+    if let Some(against) = &cli.against {
+        let theirs = load_external_results(&fs::read_to_string(against)?)?;
+        let divergence = find_divergences(&results, &theirs);
+        info!(
+            "\n🔀 {} of {} tests compared with {} diverge ({} without a result there)",
+            divergence.divergences.len(),
+            divergence.compared,
+            against.display(),
+            divergence.missing
+        );
+        fs::write(&cli.divergence, serde_json::to_string_pretty(&divergence)?)?;
+        info!("📄 Wrote divergence report to {}", cli.divergence.display());
+    }
+
+    if let Some(path) = &cli.feature_support {
+        let counts = tally_features(test_features.iter().map(|(f, status)| (f, *status)));
+        fs::write(path, serde_json::to_string_pretty(&counts)?)?;
+        info!(
+            "📄 Wrote support of {} features to {}",
+            counts.len(),
+            path.display()
+        );
+    }
+
+    // Keep the report stable for diffs whatever order the tests ran in
+    results.sort_by(|a, b| (&a.suite, &a.name).cmp(&(&b.suite, &b.name)));
+    let mut report = TestReport::new(results);
+    report.total_time_ms = start.elapsed().as_secs_f64() * 1000.0;
+    report.run_time_ms = run_time.as_secs_f64() * 1000.0;
+    if report.groups.len() > 1 {
+        info!("\n📊 === Pass Rate by Group ===");
+        info!("{}", report.groups_table().trim_end());
+    }
+    if report.timing.histogram.iter().any(|b| b.count > 0) {
+        info!("\n⏱️  === Time per Test ===");
+        info!("{}", report.timing_table().trim_end());
+    }
+
+    if let Some(output) = &cli.output {
+        if cli.failures_only {
+            report.retain_failures();
+        }
+        let rendered = if cli.canonical {
+            report.canonical_json()?
+        } else {
+            report.render(cli.format)?
+        };
+        fs::write(output, rendered)?;
+        info!("📄 Wrote results report to {}", output.display());
+    }
+
+    let total_ms = start.elapsed().as_secs_f64() * 1000.0;
+    let run_ms = run_time.as_secs_f64() * 1000.0;
+    info!(
+        "⏱️  Total time: {total_ms:.0}ms (tests {run_ms:.0}ms, setup and I/O {:.0}ms)",
+        total_ms - run_ms
+    );
+
+    let all_passed = total_failed == 0 && total_errors == 0;
+    if all_passed {
+        info!("🎉 All tests passed!");
     } else {
-        println!("🎉 All tests passed!");
+        info!("💥 Some tests failed or errored.");
     }
 
-    Ok(())
+    Ok(all_passed)
 }
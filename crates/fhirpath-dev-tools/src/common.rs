@@ -27,22 +27,39 @@ pub async fn create_dev_model_provider() -> Arc<dyn ModelProvider + Send + Sync>
 
     log::info!("Using EmbeddedModelProvider for development tools (FHIR version: {fhir_version})");
 
-    let version = match fhir_version.to_lowercase().as_str() {
-        "r4" => FhirVersion::R4,
-        "r4b" => FhirVersion::R4B,
-        "r5" => FhirVersion::R5,
-        "r6" => FhirVersion::R6,
-        _ => {
-            log::warn!("Unknown FHIR version '{fhir_version}', defaulting to R4");
-            FhirVersion::R4
-        }
-    };
+    let version = parse_fhir_version(&fhir_version).unwrap_or_else(|_| {
+        log::warn!("Unknown FHIR version '{fhir_version}', defaulting to R4");
+        FhirVersion::R4
+    });
 
     let provider = EmbeddedSchemaProvider::new(version);
 
     Arc::new(provider)
 }
 
+/// Parse a FHIR version name such as `r4`, `R4B` or `r5`
+pub fn parse_fhir_version(name: &str) -> Result<FhirVersion, String> {
+    match name.to_lowercase().as_str() {
+        "r4" => Ok(FhirVersion::R4),
+        "r4b" => Ok(FhirVersion::R4B),
+        "r5" => Ok(FhirVersion::R5),
+        "r6" => Ok(FhirVersion::R6),
+        _ => Err(format!(
+            "unknown FHIR version '{name}' (expected r4, r4b, r5 or r6)"
+        )),
+    }
+}
+
+/// Lowercase name of a FHIR version, as used in tx.fhir.org endpoints
+pub fn fhir_version_name(version: FhirVersion) -> &'static str {
+    match version {
+        FhirVersion::R4B => "r4b",
+        FhirVersion::R5 => "r5",
+        FhirVersion::R6 => "r6",
+        _ => "r4",
+    }
+}
+
 /// Create a mock model provider specifically for unit tests
 /// This should only be used in unit tests where speed is more important than accuracy
 #[cfg(test)]
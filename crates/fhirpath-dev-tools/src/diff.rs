@@ -0,0 +1,147 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Side-by-side diffs of expected and actual test results
+
+use crate::test_support::{is_wildcard, json_values_equal};
+use serde_json::Value;
+use std::fmt::Write;
+
+const RED: &str = "\x1b[31m";
+const GREEN: &str = "\x1b[32m";
+const RESET: &str = "\x1b[0m";
+
+// Widest expected column before long values are left unpadded
+const MAX_COLUMN_WIDTH: usize = 48;
+
+fn items(value: &Value) -> Vec<&Value> {
+    match value {
+        Value::Null => Vec::new(),
+        Value::Array(items) => items.iter().collect(),
+        single => vec![single],
+    }
+}
+
+/// Whether an actual row meets its expected row; rows are items or `{type, value}`
+/// objects, and an expected [`crate::test_support::WILDCARD`] value needs only the type
+/// to agree
+fn rows_match(expected: &Value, actual: &Value) -> bool {
+    match expected.get("value") {
+        _ if is_wildcard(expected) => true,
+        Some(value) if is_wildcard(value) => expected.get("type") == actual.get("type"),
+        _ => json_values_equal(expected, actual),
+    }
+}
+
+/// Render expected and actual collections side by side, one row per index
+///
+/// Rows that differ are marked with `!` and, when `color` is set, highlighted in red
+/// (expected) and green (actual). Indices missing on one side show as `-`.
+pub fn side_by_side(expected: &Value, actual: &Value, color: bool) -> String {
+    let expected_items = items(expected);
+    let actual_items = items(actual);
+    let rows = expected_items.len().max(actual_items.len());
+
+    let render = |items: &[&Value], index: usize| {
+        items
+            .get(index)
+            .map(|v| v.to_string())
+            .unwrap_or_else(|| "-".to_string())
+    };
+    let width = (0..rows)
+        .map(|i| render(&expected_items, i).chars().count())
+        .chain(std::iter::once("expected".len()))
+        .max()
+        .unwrap_or_default()
+        .min(MAX_COLUMN_WIDTH);
+
+    let mut out = String::new();
+    let _ = writeln!(out, "      #  {:<width$}  actual", "expected");
+    for index in 0..rows {
+        let expected_text = render(&expected_items, index);
+        let actual_text = render(&actual_items, index);
+        let same = match (expected_items.get(index), actual_items.get(index)) {
+            (Some(e), Some(a)) => rows_match(e, a),
+            _ => false,
+        };
+
+        if same {
+            let _ = writeln!(
+                out,
+                "    {index:>3}  {expected_text:<width$}  {actual_text}"
+            );
+        } else if color {
+            let _ = writeln!(
+                out,
+                "  ! {index:>3}  {RED}{expected_text:<width$}{RESET}  {GREEN}{actual_text}{RESET}"
+            );
+        } else {
+            let _ = writeln!(
+                out,
+                "  ! {index:>3}  {expected_text:<width$}  {actual_text}"
+            );
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn marks_differing_and_missing_rows() {
+        let diff = side_by_side(
+            &json!(["a", 2, true]),
+            &json!(["a", 2.0, false, "x"]),
+            false,
+        );
+        let lines: Vec<&str> = diff.lines().collect();
+
+        assert_eq!(lines.len(), 5);
+        assert_eq!(lines[1], "      0  \"a\"       \"a\"");
+        assert_eq!(lines[2], "      1  2         2.0");
+        assert_eq!(lines[3], "  !   2  true      false");
+        assert_eq!(lines[4], "  !   3  -         \"x\"");
+    }
+
+    #[test]
+    fn wildcard_rows_match_on_type() {
+        let expected = json!([
+            {"type": "string", "value": "*"},
+            {"type": "string", "value": "*"}
+        ]);
+        let actual = json!([
+            {"type": "string", "value": "generated"},
+            {"type": "integer", "value": 1}
+        ]);
+        let lines: Vec<String> = side_by_side(&expected, &actual, false)
+            .lines()
+            .map(str::to_string)
+            .collect();
+
+        assert!(lines[1].starts_with("      0"), "{}", lines[1]);
+        assert!(lines[2].starts_with("  !   1"), "{}", lines[2]);
+    }
+
+    #[test]
+    fn colors_only_differing_rows() {
+        let diff = side_by_side(&json!([1, 2]), &json!([1, 3]), true);
+        let lines: Vec<&str> = diff.lines().collect();
+
+        assert!(!lines[1].contains(RED));
+        assert!(lines[2].contains(RED) && lines[2].contains(GREEN));
+    }
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Divergence between this engine and another implementation's test results
+//!
+//! The other implementation's results are read from a JSON report with a `results`
+//! array whose entries carry at least `name` and `status`, which is what the test
+//! runner's own `--output` report contains. Results are joined on test name.
+
+use crate::report::{TestCaseResult, TestStatus};
+use crate::test_support::json_values_equal;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::HashMap;
+
+/// One test result from another implementation's report
+#[derive(Debug, Clone, Deserialize)]
+pub struct ExternalResult {
+    pub name: String,
+    pub status: TestStatus,
+    #[serde(default)]
+    pub actual: Option<Value>,
+    #[serde(default)]
+    pub input_hash: Option<String>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+struct ExternalReport {
+    results: Vec<ExternalResult>,
+}
+
+/// Load the results of another implementation from its JSON report
+pub fn load_external_results(content: &str) -> Result<Vec<ExternalResult>, String> {
+    serde_json::from_str::<ExternalReport>(content)
+        .map(|report| report.results)
+        .map_err(|e| format!("Failed to parse results to compare against: {e}"))
+}
+
+/// How the two implementations disagree on a test
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum DivergenceKind {
+    /// This engine passes, the other implementation does not
+    OnlyOursPasses,
+    /// The other implementation passes, this engine does not
+    OnlyTheirsPasses,
+    /// Both fail, with different actual results
+    ActualsDiffer,
+    /// The two runs used different input data for the test, so their results say
+    /// nothing about each other
+    InputsDiffer,
+}
+
+/// A test the two implementations disagree on
+#[derive(Debug, Clone, Serialize)]
+pub struct Divergence {
+    pub suite: String,
+    pub name: String,
+    pub kind: DivergenceKind,
+    pub ours: TestStatus,
+    pub theirs: TestStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub our_actual: Option<Value>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub their_actual: Option<Value>,
+}
+
+/// Outcome of comparing two implementations' results
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct DivergenceReport {
+    /// Tests run by both implementations and skipped by neither
+    pub compared: usize,
+    /// Tests with no result from the other implementation
+    pub missing: usize,
+    pub divergences: Vec<Divergence>,
+}
+
+/// Join our results with the other implementation's on test name and list disagreements
+pub fn find_divergences(ours: &[TestCaseResult], theirs: &[ExternalResult]) -> DivergenceReport {
+    let theirs: HashMap<&str, &ExternalResult> =
+        theirs.iter().map(|r| (r.name.as_str(), r)).collect();
+
+    let mut report = DivergenceReport::default();
+    for result in ours {
+        let Some(other) = theirs.get(result.name.as_str()) else {
+            report.missing += 1;
+            continue;
+        };
+        if result.status == TestStatus::Skipped || other.status == TestStatus::Skipped {
+            continue;
+        }
+        report.compared += 1;
+
+        let we_pass = result.status == TestStatus::Passed;
+        let they_pass = other.status == TestStatus::Passed;
+        let inputs_differ = matches!(
+            (&result.input_hash, &other.input_hash),
+            (Some(ours), Some(theirs)) if ours != theirs
+        );
+        let kind = match (we_pass, they_pass) {
+            _ if inputs_differ => DivergenceKind::InputsDiffer,
+            (true, false) => DivergenceKind::OnlyOursPasses,
+            (false, true) => DivergenceKind::OnlyTheirsPasses,
+            (false, false) => match (&result.actual, &other.actual) {
+                (Some(ours), Some(theirs)) if !json_values_equal(ours, theirs) => {
+                    DivergenceKind::ActualsDiffer
+                }
+                _ => continue,
+            },
+            (true, true) => continue,
+        };
+        report.divergences.push(Divergence {
+            suite: result.suite.clone(),
+            name: result.name.clone(),
+            kind,
+            ours: result.status,
+            theirs: other.status,
+            our_actual: result.actual.clone(),
+            their_actual: other.actual.clone(),
+        });
+    }
+    report
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn ours(name: &str, status: TestStatus, actual: Option<Value>) -> TestCaseResult {
+        TestCaseResult {
+            suite: "math".to_string(),
+            name: name.to_string(),
+            expression: "1 + 1".to_string(),
+            status,
+            message: None,
+            skip_reason: None,
+            mismatch: None,
+            actual,
+            traces: Vec::new(),
+            input_hash: Some("0123456789abcdef".to_string()),
+            time_ms: 0.0,
+        }
+    }
+
+    #[test]
+    fn lists_tests_the_implementations_disagree_on() {
+        let theirs = load_external_results(
+            &json!({"results": [
+                {"name": "testA", "status": "failed", "actual": [3]},
+                {"name": "testB", "status": "passed"},
+                {"name": "testC", "status": "failed", "actual": [4]},
+                {"name": "testD", "status": "failed", "actual": [5]},
+                {"name": "testE", "status": "passed"},
+                {"name": "testG", "status": "passed", "input_hash": "fedcba9876543210"}
+            ]})
+            .to_string(),
+        )
+        .unwrap();
+        let report = find_divergences(
+            &[
+                ours("testA", TestStatus::Passed, None),
+                ours("testB", TestStatus::Failed, Some(json!([1]))),
+                ours("testC", TestStatus::Failed, Some(json!([2]))),
+                ours("testD", TestStatus::Failed, Some(json!([5.0]))),
+                ours("testE", TestStatus::Passed, None),
+                ours("testF", TestStatus::Passed, None),
+                ours("testG", TestStatus::Passed, None),
+            ],
+            &theirs,
+        );
+
+        assert_eq!(report.compared, 6);
+        assert_eq!(report.missing, 1);
+        let kinds: Vec<(&str, DivergenceKind)> = report
+            .divergences
+            .iter()
+            .map(|d| (d.name.as_str(), d.kind))
+            .collect();
+        assert_eq!(
+            kinds,
+            [
+                ("testA", DivergenceKind::OnlyOursPasses),
+                ("testB", DivergenceKind::OnlyTheirsPasses),
+                ("testC", DivergenceKind::ActualsDiffer),
+                ("testG", DivergenceKind::InputsDiffer),
+            ]
+        );
+    }
+}
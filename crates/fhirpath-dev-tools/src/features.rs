@@ -0,0 +1,152 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Feature support scorecard derived from test results
+//!
+//! Each test's expression is parsed and the functions and operators it uses are read off
+//! the AST, so `where()` inside a string literal does not count. Tallying pass and fail
+//! counts per feature then shows which parts of the language are failing, without tagging
+//! tests by hand.
+
+use crate::report::TestStatus;
+use crate::test_support::ast_tree;
+use octofhir_fhirpath::ast::{BinaryOperator, UnaryOperator};
+use serde::Serialize;
+use serde_json::Value;
+use std::collections::{BTreeMap, BTreeSet};
+
+/// Pass and fail counts of the tests using a feature
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize)]
+pub struct FeatureCounts {
+    pub passed: usize,
+    /// Tests that failed or errored
+    pub failed: usize,
+}
+
+/// Functions (`where()`) and operators (`+`, `and`, `is`) used by an expression; empty
+/// when it does not parse
+pub fn expression_features(expression: &str) -> BTreeSet<String> {
+    let mut features = BTreeSet::new();
+    if let Ok(ast) = octofhir_fhirpath::parse_ast(expression) {
+        collect_features(&ast_tree(&ast), &mut features);
+    }
+    features
+}
+
+/// Collect features from the JSON tree of an AST (see [`ast_tree`])
+pub fn collect_features(tree: &Value, features: &mut BTreeSet<String>) {
+    match tree {
+        Value::Object(map) => {
+            for (tag, node) in map {
+                if let Some(feature) = node_feature(tag, node) {
+                    features.insert(feature);
+                }
+                collect_features(node, features);
+            }
+        }
+        Value::Array(items) => items
+            .iter()
+            .for_each(|item| collect_features(item, features)),
+        _ => {}
+    }
+}
+
+fn node_feature(tag: &str, node: &Value) -> Option<String> {
+    let operator = || node.get("operator").cloned();
+    match tag {
+        "FunctionCall" => Some(format!("{}()", node.get("name")?.as_str()?)),
+        "MethodCall" => Some(format!("{}()", node.get("method")?.as_str()?)),
+        "BinaryOperation" => serde_json::from_value::<BinaryOperator>(operator()?)
+            .ok()
+            .map(|op| op.to_string()),
+        "UnaryOperation" => serde_json::from_value::<UnaryOperator>(operator()?)
+            .ok()
+            .map(|op| op.to_string()),
+        "Filter" => Some("where()".to_string()),
+        "IndexAccess" => Some("[]".to_string()),
+        "Union" => Some("|".to_string()),
+        "TypeCast" => Some("as".to_string()),
+        "TypeCheck" => Some("is".to_string()),
+        _ => None,
+    }
+}
+
+/// Tally pass and fail counts per feature; skipped tests are left out
+pub fn tally_features<'a>(
+    tests: impl IntoIterator<Item = (&'a BTreeSet<String>, TestStatus)>,
+) -> BTreeMap<String, FeatureCounts> {
+    let mut counts: BTreeMap<String, FeatureCounts> = BTreeMap::new();
+    for (features, status) in tests {
+        if status == TestStatus::Skipped {
+            continue;
+        }
+        for feature in features {
+            let entry = counts.entry(feature.clone()).or_default();
+            if status == TestStatus::Passed {
+                entry.passed += 1;
+            } else {
+                entry.failed += 1;
+            }
+        }
+    }
+    counts
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn functions_and_operators_are_read_off_the_tree() {
+        let features = expression_features(
+            "Patient.name.where(given = 'a').exists() and not (1 + 2 is Integer)",
+        );
+        assert_eq!(
+            features.into_iter().collect::<Vec<_>>(),
+            ["+", "=", "and", "exists()", "is", "not", "where()"]
+        );
+    }
+
+    #[test]
+    fn string_literals_are_not_features() {
+        let features = expression_features("name = 'where() and 1 + 2'");
+        assert_eq!(features.into_iter().collect::<Vec<_>>(), ["="]);
+    }
+
+    #[test]
+    fn features_are_tallied_per_status() {
+        let where_only: BTreeSet<String> = ["where()".to_string()].into();
+        let both: BTreeSet<String> = ["where()".to_string(), "+".to_string()].into();
+        let counts = tally_features([
+            (&where_only, TestStatus::Passed),
+            (&both, TestStatus::Failed),
+            (&both, TestStatus::Error),
+            (&both, TestStatus::Skipped),
+        ]);
+        assert_eq!(
+            counts["where()"],
+            FeatureCounts {
+                passed: 1,
+                failed: 2
+            }
+        );
+        assert_eq!(
+            counts["+"],
+            FeatureCounts {
+                passed: 0,
+                failed: 2
+            }
+        );
+    }
+}
@@ -0,0 +1,302 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! FHIR XML to JSON conversion for test inputs
+//!
+//! Follows the FHIR XML representation rules closely enough for the test suites:
+//! the root element name becomes `resourceType`, `value` attributes become primitive
+//! values, nested resources (`contained`, `Bundle.entry.resource`, `Parameters.parameter.resource`)
+//! keep their own `resourceType`, and extensions carry their `url`.
+
+use flate2::read::GzDecoder;
+use octofhir_fhir_model::ModelProvider;
+use roxmltree::Document;
+use serde_json::{Map, Value};
+use std::io::Read;
+
+// FHIR elements that are always arrays even if single occurrence
+const FHIR_ARRAY_ELEMENTS: &[&str] = &[
+    "identifier",
+    "name",
+    "telecom",
+    "address",
+    "contact",
+    "communication",
+    "extension",
+    "modifierExtension",
+    "given",
+    "prefix",
+    "suffix",
+    "line",
+    "coding",
+    "contained",
+    "link",
+    "photo",
+    "generalPractitioner",
+];
+
+// Elements whose single child element is a whole resource
+const RESOURCE_CONTAINER_ELEMENTS: &[&str] = &["contained", "resource", "outcome"];
+
+fn is_array_element(name: &str) -> bool {
+    FHIR_ARRAY_ELEMENTS.contains(&name)
+}
+
+fn append_to_json_object(obj: &mut Map<String, Value>, key: &str, value: Value) {
+    match obj.get_mut(key) {
+        Some(existing) => {
+            if let Some(items) = existing.as_array_mut() {
+                items.push(value);
+            } else {
+                let old = existing.take();
+                *existing = Value::Array(vec![old, value]);
+            }
+        }
+        None => {
+            if is_array_element(key) {
+                obj.insert(key.to_string(), Value::Array(vec![value]));
+            } else {
+                obj.insert(key.to_string(), value);
+            }
+        }
+    }
+}
+
+/// Convert a FHIR XML document into its FHIR JSON representation
+pub fn from_xml(input: &str) -> Result<Value, String> {
+    let doc = Document::parse(input).map_err(|e| format!("XML parse error: {e}"))?;
+    convert_resource(&doc.root_element())
+}
+
+/// Parse test input content, picking XML or JSON based on the file extension
+pub fn parse_input(filename: &str, content: &str) -> Result<Value, String> {
+    if filename.to_ascii_lowercase().ends_with(".xml") {
+        from_xml(content)
+    } else {
+        serde_json::from_str(content)
+            .map_err(|e| format!("Failed to parse JSON in {filename}: {e}"))
+    }
+}
+
+/// Name of a test input file without its `.gz` extension, if it is gzipped
+fn gzip_inner_name(filename: &str) -> Option<&str> {
+    let split = filename.len().checked_sub(".gz".len())?;
+    filename
+        .get(split..)
+        .filter(|ext| ext.eq_ignore_ascii_case(".gz"))
+        .map(|_| &filename[..split])
+}
+
+/// Whether a test input file holds FHIR XML, gzipped or not
+pub fn is_xml_input(filename: &str) -> bool {
+    gzip_inner_name(filename)
+        .unwrap_or(filename)
+        .to_ascii_lowercase()
+        .ends_with(".xml")
+}
+
+/// Parse the raw bytes of a test input file, decompressing `.gz` files first
+///
+/// The extension beneath `.gz` picks XML or JSON, as for [`parse_input`]. A file that
+/// does not decompress is reported as such rather than as a parse error.
+pub fn parse_input_bytes(filename: &str, bytes: &[u8]) -> Result<Value, String> {
+    match gzip_inner_name(filename) {
+        Some(inner) => {
+            let mut content = String::new();
+            GzDecoder::new(bytes)
+                .read_to_string(&mut content)
+                .map_err(|e| format!("Failed to decompress {filename}: {e}"))?;
+            parse_input(inner, &content)
+        }
+        None => {
+            let content = std::str::from_utf8(bytes)
+                .map_err(|e| format!("Input file {filename} is not UTF-8: {e}"))?;
+            parse_input(filename, content)
+        }
+    }
+}
+
+/// Ensure the resource type declared by a converted document is known to the model provider
+pub async fn ensure_supported_resource_type(
+    resource: &Value,
+    model_provider: &dyn ModelProvider,
+) -> Result<(), String> {
+    let resource_type = resource
+        .get("resourceType")
+        .and_then(|v| v.as_str())
+        .ok_or_else(|| "Input has no resourceType".to_string())?;
+
+    match model_provider.get_type(resource_type).await {
+        Ok(Some(_)) => Ok(()),
+        Ok(None) => Err(format!("Unsupported resourceType '{resource_type}'")),
+        Err(e) => Err(format!(
+            "Failed to resolve resourceType '{resource_type}': {e}"
+        )),
+    }
+}
+
+fn convert_resource(element: &roxmltree::Node) -> Result<Value, String> {
+    let mut obj = Map::new();
+    obj.insert(
+        "resourceType".to_string(),
+        Value::String(element.tag_name().name().to_string()),
+    );
+    convert_element_children(element, &mut obj)?;
+    Ok(Value::Object(obj))
+}
+
+fn convert_element_children(
+    element: &roxmltree::Node,
+    obj: &mut Map<String, Value>,
+) -> Result<(), String> {
+    for child in element.children() {
+        if child.is_element() {
+            let child_name = child.tag_name().name();
+            let child_value = convert_element(&child)?;
+            append_to_json_object(obj, child_name, child_value);
+        }
+    }
+    Ok(())
+}
+
+fn convert_element(element: &roxmltree::Node) -> Result<Value, String> {
+    let element_name = element.tag_name().name();
+
+    // Handle special cases
+    if element_name == "div" {
+        return Ok(Value::String(get_element_text_content(element)));
+    }
+
+    let child_elements: Vec<_> = element.children().filter(|n| n.is_element()).collect();
+
+    if RESOURCE_CONTAINER_ELEMENTS.contains(&element_name)
+        && child_elements.len() == 1
+        && child_elements[0]
+            .tag_name()
+            .name()
+            .starts_with(|c: char| c.is_ascii_uppercase())
+    {
+        return convert_resource(&child_elements[0]);
+    }
+
+    let value_attr = element.attribute("value");
+    let id_attr = element.attribute("id");
+    let url_attr = element.attribute("url");
+
+    if child_elements.is_empty() && id_attr.is_none() && url_attr.is_none() {
+        // Leaf element - return the value attribute or empty object
+        return Ok(match value_attr {
+            Some(value) => Value::String(value.to_string()),
+            None => Value::Object(Map::new()),
+        });
+    }
+
+    let mut obj = Map::new();
+    if let Some(id) = id_attr {
+        obj.insert("id".to_string(), Value::String(id.to_string()));
+    }
+    if let Some(url) = url_attr {
+        obj.insert("url".to_string(), Value::String(url.to_string()));
+    }
+    if let Some(value) = value_attr {
+        obj.insert("value".to_string(), Value::String(value.to_string()));
+    }
+    convert_element_children(element, &mut obj)?;
+
+    Ok(Value::Object(obj))
+}
+
+fn get_element_text_content(element: &roxmltree::Node) -> String {
+    let mut result = String::new();
+
+    for child in element.children() {
+        if child.is_text() {
+            result.push_str(child.text().unwrap_or(""));
+        } else if child.is_element() {
+            // Simplified XHTML reconstruction; attributes are not preserved
+            result.push_str(&format!("<{}>", child.tag_name().name()));
+            result.push_str(&get_element_text_content(&child));
+            result.push_str(&format!("</{}>", child.tag_name().name()));
+        }
+    }
+
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn uses_root_element_name_as_resource_type() {
+        let value = from_xml(
+            r#"<Observation xmlns="http://hl7.org/fhir"><status value="final"/></Observation>"#,
+        )
+        .unwrap();
+        assert_eq!(value["resourceType"], json!("Observation"));
+        assert_eq!(value["status"], json!("final"));
+    }
+
+    #[test]
+    fn converts_contained_resources_and_extensions() {
+        let xml = r#"<Patient xmlns="http://hl7.org/fhir">
+            <contained><Practitioner><id value="p1"/></Practitioner></contained>
+            <extension url="http://example.org/ext"><valueString value="x"/></extension>
+            <name><given value="Peter"/><given value="James"/></name>
+        </Patient>"#;
+        let value = from_xml(xml).unwrap();
+
+        assert_eq!(
+            value["contained"],
+            json!([{"resourceType": "Practitioner", "id": "p1"}])
+        );
+        assert_eq!(
+            value["extension"],
+            json!([{"url": "http://example.org/ext", "valueString": "x"}])
+        );
+        assert_eq!(value["name"][0]["given"], json!(["Peter", "James"]));
+    }
+
+    #[test]
+    fn parse_input_dispatches_on_extension() {
+        let json_value = parse_input("patient.json", r#"{"resourceType": "Patient"}"#).unwrap();
+        assert_eq!(json_value["resourceType"], json!("Patient"));
+        assert!(parse_input("patient.xml", "not xml").is_err());
+    }
+
+    #[test]
+    fn gzipped_input_is_decompressed_before_parsing() {
+        use flate2::Compression;
+        use flate2::write::GzEncoder;
+        use std::io::Write;
+
+        let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+        encoder
+            .write_all(br#"<Patient xmlns="http://hl7.org/fhir"><gender value="male"/></Patient>"#)
+            .unwrap();
+        let compressed = encoder.finish().unwrap();
+
+        assert!(is_xml_input("bundle.xml.GZ"));
+        assert!(!is_xml_input("bundle.json.gz"));
+        let value = parse_input_bytes("patient.xml.gz", &compressed).unwrap();
+        assert_eq!(value["resourceType"], json!("Patient"));
+        assert_eq!(value["gender"], json!("male"));
+
+        let not_gzip = parse_input_bytes("patient.json.gz", b"{}").unwrap_err();
+        assert!(not_gzip.starts_with("Failed to decompress patient.json.gz"));
+        let bad_json = parse_input_bytes("patient.json.gz", &compressed).unwrap_err();
+        assert!(bad_json.starts_with("Failed to parse JSON in patient.json"));
+    }
+}
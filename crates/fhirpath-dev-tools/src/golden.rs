@@ -0,0 +1,169 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Golden files of parsed expression ASTs
+//!
+//! A golden file maps each test name to the JSON tree of its parsed expression, without
+//! source locations, or to `{"error": ...}` when the expression does not parse. Comparing
+//! a fresh dump against it shows parser changes even when evaluation results still match.
+
+use serde_json::{Value, json};
+use std::collections::BTreeMap;
+
+/// Parsed ASTs keyed by test name
+pub type GoldenAsts = BTreeMap<String, Value>;
+
+/// Golden entry for an expression that fails to parse
+pub fn parse_error_entry(message: &str) -> Value {
+    json!({ "error": message })
+}
+
+/// Outcome of comparing a fresh AST dump with a golden file
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct GoldenComparison {
+    /// Tests whose AST changed, with the structural differences
+    pub changed: Vec<(String, Vec<String>)>,
+    /// Tests missing from the golden file
+    pub added: Vec<String>,
+    /// Tests in the golden file that were not dumped
+    pub removed: Vec<String>,
+}
+
+impl GoldenComparison {
+    pub fn is_clean(&self) -> bool {
+        self.changed.is_empty() && self.added.is_empty() && self.removed.is_empty()
+    }
+}
+
+/// Compare a fresh AST dump with the golden one
+pub fn compare_golden(golden: &GoldenAsts, current: &GoldenAsts) -> GoldenComparison {
+    let mut comparison = GoldenComparison::default();
+    for (name, tree) in current {
+        match golden.get(name) {
+            Some(expected) => {
+                let differences = structural_diff(expected, tree);
+                if !differences.is_empty() {
+                    comparison.changed.push((name.clone(), differences));
+                }
+            }
+            None => comparison.added.push(name.clone()),
+        }
+    }
+    comparison.removed = golden
+        .keys()
+        .filter(|name| !current.contains_key(*name))
+        .cloned()
+        .collect();
+    comparison
+}
+
+/// List the differences between two JSON trees, each prefixed with its JSON pointer
+pub fn structural_diff(expected: &Value, actual: &Value) -> Vec<String> {
+    let mut differences = Vec::new();
+    diff_at("", expected, actual, &mut differences);
+    differences
+}
+
+fn diff_at(path: &str, expected: &Value, actual: &Value, differences: &mut Vec<String>) {
+    let at = if path.is_empty() { "/" } else { path };
+    match (expected, actual) {
+        (Value::Object(expected), Value::Object(actual)) => {
+            for (key, expected_value) in expected {
+                let child = format!("{path}/{key}");
+                match actual.get(key) {
+                    Some(actual_value) => {
+                        diff_at(&child, expected_value, actual_value, differences)
+                    }
+                    None => differences.push(format!("{child}: missing")),
+                }
+            }
+            for key in actual.keys().filter(|key| !expected.contains_key(*key)) {
+                differences.push(format!("{path}/{key}: unexpected"));
+            }
+        }
+        (Value::Array(expected), Value::Array(actual)) => {
+            if expected.len() != actual.len() {
+                differences.push(format!(
+                    "{at}: {} items, expected {}",
+                    actual.len(),
+                    expected.len()
+                ));
+                return;
+            }
+            for (index, (expected_item, actual_item)) in expected.iter().zip(actual).enumerate() {
+                diff_at(
+                    &format!("{path}/{index}"),
+                    expected_item,
+                    actual_item,
+                    differences,
+                );
+            }
+        }
+        _ if expected != actual => differences.push(format!("{at}: {actual}, expected {expected}")),
+        _ => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn differences_are_reported_by_path() {
+        let golden: GoldenAsts = [
+            (
+                "testAdd".to_string(),
+                json!({"Binary": {"op": "Add", "operands": [{"Literal": 1}, {"Literal": 2}]}}),
+            ),
+            ("testGone".to_string(), json!({"Identifier": "a"})),
+        ]
+        .into();
+        let current: GoldenAsts = [
+            (
+                "testAdd".to_string(),
+                json!({"Binary": {"op": "Subtract", "operands": [{"Literal": 1}, {"Literal": 2}]}}),
+            ),
+            ("testNew".to_string(), parse_error_entry("unexpected token")),
+        ]
+        .into();
+
+        let comparison = compare_golden(&golden, &current);
+        assert_eq!(
+            comparison.changed,
+            [(
+                "testAdd".to_string(),
+                vec!["/Binary/op: \"Subtract\", expected \"Add\"".to_string()]
+            )]
+        );
+        assert_eq!(comparison.added, ["testNew"]);
+        assert_eq!(comparison.removed, ["testGone"]);
+        assert!(!comparison.is_clean());
+    }
+
+    #[test]
+    fn missing_keys_and_array_lengths_are_structural_differences() {
+        assert_eq!(
+            structural_diff(
+                &json!({"args": [1, 2], "name": "where"}),
+                &json!({"args": [1], "kind": "fn"})
+            ),
+            [
+                "/args: 1 items, expected 2",
+                "/name: missing",
+                "/kind: unexpected"
+            ]
+        );
+        assert!(structural_diff(&json!([1, {"a": null}]), &json!([1, {"a": null}])).is_empty());
+    }
+}
@@ -17,9 +17,25 @@
 //! This crate provides development and testing utilities for the FHIRPath implementation,
 //! including test runners, coverage analysis, and benchmarking tools.
 
+pub mod bench_stats;
 pub mod common;
+pub mod diff;
+pub mod divergence;
+pub mod features;
+pub mod fhir_xml;
+pub mod golden;
+pub mod logging;
 pub mod metadata;
+pub mod panics;
+pub mod remote;
+pub mod report;
+pub mod runner;
+pub mod selftest;
+pub mod shuffle;
+pub mod temporal;
 pub mod test_support;
+pub mod traces;
+pub mod watch;
 
 // Re-export common functionality
 pub use common::*;
@@ -0,0 +1,152 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Leveled logging for the dev tool binaries
+//!
+//! The text format writes each message as is, info and debug to stdout and warnings and
+//! errors to stderr, so interactive output reads the same as plain prints. The JSON format
+//! writes one object per message with its timestamp, level and target, for CI logs and
+//! scripts. Messages from other crates, such as the engine, only show up at debug level
+//! unless they are warnings or errors.
+
+use log::{Level, LevelFilter, Log, Metadata, Record};
+use serde_json::json;
+use std::io::Write;
+
+/// Most detailed messages to show, as chosen on the command line
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, clap::ValueEnum)]
+pub enum LogLevel {
+    Error,
+    Warn,
+    #[default]
+    Info,
+    Debug,
+}
+
+impl LogLevel {
+    fn filter(self) -> LevelFilter {
+        match self {
+            Self::Error => LevelFilter::Error,
+            Self::Warn => LevelFilter::Warn,
+            Self::Info => LevelFilter::Info,
+            Self::Debug => LevelFilter::Debug,
+        }
+    }
+}
+
+/// How log messages are written
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum LogFormat {
+    #[default]
+    Text,
+    Json,
+}
+
+struct ToolLogger {
+    format: LogFormat,
+    level: LevelFilter,
+    /// Log target prefix of the binary's own messages
+    own_target: &'static str,
+}
+
+impl Log for ToolLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= self.level
+            && (metadata.target().starts_with(self.own_target)
+                || metadata.level() <= Level::Warn
+                || self.level >= LevelFilter::Debug)
+    }
+
+    fn log(&self, record: &Record) {
+        if !self.enabled(record.metadata()) {
+            return;
+        }
+        let message = record.args().to_string();
+        let Some(line) = format_record(self.format, record.level(), record.target(), &message)
+        else {
+            return;
+        };
+        if record.level() <= Level::Warn {
+            let _ = writeln!(std::io::stderr().lock(), "{line}");
+        } else {
+            let _ = writeln!(std::io::stdout().lock(), "{line}");
+        }
+    }
+
+    fn flush(&self) {
+        let _ = std::io::stdout().flush();
+    }
+}
+
+/// Render one message in the given format; `None` for blank lines in JSON, which carry
+/// nothing a script could use
+pub fn format_record(
+    format: LogFormat,
+    level: Level,
+    target: &str,
+    message: &str,
+) -> Option<String> {
+    match format {
+        LogFormat::Text => Some(message.to_string()),
+        LogFormat::Json if message.trim().is_empty() => None,
+        LogFormat::Json => Some(
+            json!({
+                "timestamp": chrono::Utc::now().to_rfc3339(),
+                "level": level.as_str().to_ascii_lowercase(),
+                "target": target,
+                "message": message.trim(),
+            })
+            .to_string(),
+        ),
+    }
+}
+
+/// Install the logger for a binary, whose crate name marks its own log targets
+pub fn init(own_target: &'static str, level: LogLevel, format: LogFormat) -> Result<(), String> {
+    let level = level.filter();
+    let logger = Box::leak(Box::new(ToolLogger {
+        format,
+        level,
+        own_target,
+    }));
+    log::set_logger(logger).map_err(|e| format!("Failed to install logger: {e}"))?;
+    log::set_max_level(level);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::Value;
+
+    #[test]
+    fn json_records_carry_level_target_and_message() {
+        let line =
+            format_record(LogFormat::Json, Level::Warn, "test_runner", "⚠️  slow\n").unwrap();
+        let record: Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(record["level"], "warn");
+        assert_eq!(record["target"], "test_runner");
+        assert_eq!(record["message"], "⚠️  slow");
+        assert!(record["timestamp"].is_string());
+
+        assert_eq!(
+            format_record(LogFormat::Json, Level::Info, "test_runner", "\n"),
+            None
+        );
+        assert_eq!(
+            format_record(LogFormat::Text, Level::Info, "test_runner", "\n📊 Summary").as_deref(),
+            Some("\n📊 Summary")
+        );
+    }
+}
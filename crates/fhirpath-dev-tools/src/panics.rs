@@ -0,0 +1,118 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Reporting panics recovered from individual test evaluations
+//!
+//! The runner catches panics per test case so one bad expression cannot abort a whole
+//! run. The panic hook installed here records a backtrace on the panicking thread, where
+//! the runner picks it up right after catching the unwind.
+
+use std::any::Any;
+use std::backtrace::Backtrace;
+use std::cell::RefCell;
+
+// Backtrace lines kept in a recovered panic report
+const MAX_BACKTRACE_LINES: usize = 24;
+
+thread_local! {
+    static LAST_BACKTRACE: RefCell<Option<String>> = const { RefCell::new(None) };
+}
+
+/// Install a panic hook that records the backtrace of each panic for [`take_backtrace`]
+///
+/// Only the panic message and location are printed, so recovered panics do not flood
+/// the output with full backtraces.
+pub fn install_backtrace_hook() {
+    std::panic::set_hook(Box::new(|info| {
+        let backtrace = Backtrace::force_capture().to_string();
+        LAST_BACKTRACE.with(|last| *last.borrow_mut() = Some(backtrace));
+        eprintln!("⚠️  {info}");
+    }));
+}
+
+/// Text of a panic payload, as passed to `panic!`
+pub fn panic_message(payload: &(dyn Any + Send)) -> String {
+    if let Some(message) = payload.downcast_ref::<&str>() {
+        message.to_string()
+    } else if let Some(message) = payload.downcast_ref::<String>() {
+        message.clone()
+    } else {
+        "panic with a non-string payload".to_string()
+    }
+}
+
+/// Take the trimmed backtrace of the last panic on this thread, if one was recorded
+pub fn take_backtrace() -> Option<String> {
+    LAST_BACKTRACE
+        .with(|last| last.borrow_mut().take())
+        .map(|backtrace| trim_backtrace(&backtrace))
+}
+
+/// Drop the frames of the panic machinery and keep the first lines below the panic site
+fn trim_backtrace(backtrace: &str) -> String {
+    let lines: Vec<&str> = backtrace.lines().collect();
+    let is_machinery = |line: &str| {
+        line.contains("panicking")
+            || line.contains("backtrace::Backtrace")
+            || line.contains("rust_begin_unwind")
+            || line.contains("panics::install_backtrace_hook")
+    };
+    let start = lines
+        .iter()
+        .rposition(|line| is_machinery(line))
+        .map_or(0, |index| index + 1);
+    // Skip the source location of the last machinery frame
+    let start = lines[start..]
+        .iter()
+        .position(|line| !line.trim_start().starts_with("at "))
+        .map_or(lines.len(), |offset| start + offset);
+
+    let kept = &lines[start..lines.len().min(start + MAX_BACKTRACE_LINES)];
+    let mut trimmed = kept.join("\n");
+    if start + kept.len() < lines.len() {
+        trimmed.push_str("\n   ...");
+    }
+    trimmed
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn messages_are_read_from_str_and_string_payloads() {
+        assert_eq!(panic_message(&"boom"), "boom");
+        assert_eq!(panic_message(&"boom".to_string()), "boom");
+        assert_eq!(panic_message(&42), "panic with a non-string payload");
+    }
+
+    #[test]
+    fn backtraces_start_below_the_panic_machinery() {
+        let backtrace = "   0: std::backtrace::Backtrace::force_capture
+             at /rustc/library/std/src/backtrace.rs:312:9
+   1: std::panicking::rust_panic_with_hook
+   2: core::panicking::panic_fmt
+             at /rustc/library/core/src/panicking.rs:75:14
+   3: octofhir_fhirpath::evaluator::evaluate_node
+             at ./src/evaluator/evaluator.rs:10:5
+   4: test_runner::run_test_case";
+
+        assert_eq!(
+            trim_backtrace(backtrace),
+            "   3: octofhir_fhirpath::evaluator::evaluate_node
+             at ./src/evaluator/evaluator.rs:10:5
+   4: test_runner::run_test_case"
+        );
+    }
+}
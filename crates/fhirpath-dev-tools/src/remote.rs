@@ -0,0 +1,155 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Input files fetched over HTTP
+//!
+//! A test's `inputfile` may be an `http://` or `https://` URL, such as one of the FHIR
+//! examples published with the specification. The file is downloaded on first use and
+//! kept in a cache directory, so later runs, including offline ones, read the local copy.
+
+use crate::fhir_xml::parse_input_bytes;
+use crate::test_support::stable_hash;
+use serde_json::Value;
+use std::fs;
+use std::io::ErrorKind;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Duration;
+
+/// Distinguishes the temporary files of downloads running at the same time
+static DOWNLOADS: AtomicUsize = AtomicUsize::new(0);
+
+/// Whether an `inputfile` refers to a remote file rather than one under `test-cases/input`
+pub fn is_remote(inputfile: &str) -> bool {
+    inputfile.starts_with("http://") || inputfile.starts_with("https://")
+}
+
+/// Where remote input files are cached and how they are fetched
+#[derive(Debug, Clone)]
+pub struct RemoteOptions {
+    /// Directory holding downloaded files
+    pub cache_dir: PathBuf,
+    /// Longest a single download may take
+    pub timeout: Duration,
+    /// Only read cached copies; a file that is not cached is an error
+    pub offline: bool,
+}
+
+impl Default for RemoteOptions {
+    fn default() -> Self {
+        Self {
+            cache_dir: PathBuf::from("target/remote-inputs"),
+            timeout: Duration::from_secs(30),
+            offline: false,
+        }
+    }
+}
+
+impl RemoteOptions {
+    /// Cached copy of `url`, named by a hash of the URL followed by its last path segment,
+    /// so the extension still tells how the file is parsed
+    pub fn cache_path(&self, url: &str) -> PathBuf {
+        let path = url.split(['?', '#']).next().unwrap_or_default();
+        let name = path.rsplit('/').find(|s| !s.is_empty()).unwrap_or("input");
+        self.cache_dir
+            .join(format!("{}-{name}", stable_hash(url.as_bytes())))
+    }
+
+    /// Contents of `url`, from the cache when it has a copy and downloaded into it otherwise
+    ///
+    /// A download is kept only once it parses as an input file, and it is moved into the
+    /// cache whole, so concurrent runs never read a partial or unusable copy.
+    pub async fn fetch(&self, url: &str) -> Result<Value, String> {
+        let cached = self.cache_path(url);
+        match fs::read(&cached) {
+            Ok(bytes) => return parse_input_bytes(url, &bytes),
+            Err(e) if e.kind() != ErrorKind::NotFound => {
+                return Err(format!("Failed to read {}: {e}", cached.display()));
+            }
+            Err(_) => {}
+        }
+        if self.offline {
+            return Err(format!(
+                "{url} is not cached in {} and network access is disabled",
+                self.cache_dir.display()
+            ));
+        }
+
+        let client = reqwest::Client::builder()
+            .timeout(self.timeout)
+            .build()
+            .map_err(|e| format!("Failed to create HTTP client: {e}"))?;
+        let response = client
+            .get(url)
+            .send()
+            .await
+            .and_then(|response| response.error_for_status())
+            .map_err(|e| format!("Failed to fetch {url}: {e}"))?;
+        let bytes = response
+            .bytes()
+            .await
+            .map_err(|e| format!("Failed to fetch {url}: {e}"))?
+            .to_vec();
+        let value = parse_input_bytes(url, &bytes)?;
+
+        let partial = self.cache_dir.join(format!(
+            ".{}-{}.partial",
+            std::process::id(),
+            DOWNLOADS.fetch_add(1, Ordering::Relaxed)
+        ));
+        fs::create_dir_all(&self.cache_dir)
+            .and_then(|()| fs::write(&partial, &bytes))
+            .and_then(|()| fs::rename(&partial, &cached))
+            .map_err(|e| {
+                let _ = fs::remove_file(&partial);
+                format!("Failed to cache {url} in {}: {e}", cached.display())
+            })?;
+        Ok(value)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn offline_fetches_read_only_the_cache() {
+        let options = RemoteOptions {
+            cache_dir: std::env::temp_dir().join(format!("remote-inputs-{}", std::process::id())),
+            offline: true,
+            ..RemoteOptions::default()
+        };
+        let url = "https://hl7.org/fhir/patient-example.json?format=json";
+        let cached = options.cache_path(url);
+        assert!(is_remote(url));
+        assert!(!is_remote("patient-example.json"));
+        assert!(cached.starts_with(&options.cache_dir));
+        assert!(cached.to_string_lossy().ends_with("-patient-example.json"));
+        assert_ne!(
+            cached,
+            options.cache_path("https://hl7.org/fhir/R4/patient-example.json")
+        );
+
+        let error = options.fetch(url).await.unwrap_err();
+        assert!(error.contains("network access is disabled"), "{error}");
+
+        fs::create_dir_all(&options.cache_dir).unwrap();
+        fs::write(&cached, br#"{"resourceType": "Patient"}"#).unwrap();
+        assert_eq!(
+            options.fetch(url).await.unwrap(),
+            serde_json::json!({"resourceType": "Patient"})
+        );
+        fs::remove_dir_all(&options.cache_dir).unwrap();
+    }
+}
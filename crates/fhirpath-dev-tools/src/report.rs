@@ -0,0 +1,945 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Machine-readable test run reports
+//!
+//! Collects per-test outcomes from the test runner and serializes them either as JSON
+//! (the default) or as JUnit XML for CI dashboards. Results can also be streamed as JSON
+//! lines while the run is in progress, so a crash keeps everything written so far.
+
+use crate::traces::TraceEntry;
+use quick_xml::escape::escape;
+use serde::{Deserialize, Serialize};
+use serde_json::{Value, json};
+use std::collections::BTreeMap;
+use std::fmt::{self, Write};
+use std::fs;
+use std::io;
+use std::path::Path;
+
+/// Outcome of a single test case
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TestStatus {
+    Passed,
+    Failed,
+    Error,
+    Skipped,
+}
+
+/// Why a test case was skipped instead of evaluated
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum SkipReason {
+    Disabled,
+    MissingInput,
+    UnsupportedResource,
+}
+
+impl fmt::Display for SkipReason {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::Disabled => "disabled",
+            Self::MissingInput => "missing input data",
+            Self::UnsupportedResource => "unsupported resource",
+        })
+    }
+}
+
+/// How a failed test's result differed from the expectation
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum MismatchKind {
+    /// Same value in a different type, such as `true` against `"true"`
+    TypeMismatch,
+    ValueMismatch,
+    /// Different number of items
+    CardinalityMismatch,
+    /// Failed as expected, but with an error not containing `expectedError`
+    WrongError,
+    /// Number of items outside the test's `expectedCardinality`
+    CardinalityViolation,
+}
+
+impl fmt::Display for MismatchKind {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::TypeMismatch => "type mismatch",
+            Self::ValueMismatch => "value mismatch",
+            Self::CardinalityMismatch => "cardinality mismatch",
+            Self::WrongError => "wrong error",
+            Self::CardinalityViolation => "cardinality violation",
+        })
+    }
+}
+
+/// Result of a single test case as recorded in a report
+#[derive(Debug, Clone, Serialize)]
+pub struct TestCaseResult {
+    pub suite: String,
+    pub name: String,
+    pub expression: String,
+    pub status: TestStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub message: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub skip_reason: Option<SkipReason>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub mismatch: Option<MismatchKind>,
+    /// Actual result of a failed comparison, as `{type, value}` items; integers are JSON
+    /// numbers and decimals strings keeping their scale (see
+    /// [`crate::test_support::report_value`])
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub actual: Option<serde_json::Value>,
+    /// Values the expression emitted through `trace()`
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub traces: Vec<TraceEntry>,
+    /// Fingerprint of the input data the test ran against (see
+    /// [`crate::test_support::input_fingerprint`])
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub input_hash: Option<String>,
+    pub time_ms: f64,
+}
+
+/// Aggregated counts for a report
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ReportSummary {
+    pub total: usize,
+    pub passed: usize,
+    pub failed: usize,
+    pub errors: usize,
+    pub skipped: usize,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub skipped_by_reason: BTreeMap<SkipReason, usize>,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub failed_by_mismatch: BTreeMap<MismatchKind, usize>,
+}
+
+impl ReportSummary {
+    fn from_results<'a>(results: impl IntoIterator<Item = &'a TestCaseResult>) -> Self {
+        let mut summary = Self::default();
+        for result in results {
+            summary.total += 1;
+            match result.status {
+                TestStatus::Passed => summary.passed += 1,
+                TestStatus::Failed => summary.failed += 1,
+                TestStatus::Error => summary.errors += 1,
+                TestStatus::Skipped => summary.skipped += 1,
+            }
+            if let Some(reason) = result.skip_reason {
+                *summary.skipped_by_reason.entry(reason).or_default() += 1;
+            }
+            if let Some(kind) = result.mismatch {
+                *summary.failed_by_mismatch.entry(kind).or_default() += 1;
+            }
+        }
+        summary
+    }
+}
+
+// Results written between flushes of a result stream
+const STREAM_FLUSH_INTERVAL: usize = 25;
+
+/// Writes test case results as JSON lines as they complete
+pub struct ResultStream<W: io::Write> {
+    out: W,
+    unflushed: usize,
+}
+
+impl<W: io::Write> ResultStream<W> {
+    pub fn new(out: W) -> Self {
+        Self { out, unflushed: 0 }
+    }
+
+    /// Append one result, flushing every few results
+    pub fn push(&mut self, result: &TestCaseResult) -> io::Result<()> {
+        serde_json::to_writer(&mut self.out, result)?;
+        self.out.write_all(b"\n")?;
+        self.unflushed += 1;
+        if self.unflushed >= STREAM_FLUSH_INTERVAL {
+            self.out.flush()?;
+            self.unflushed = 0;
+        }
+        Ok(())
+    }
+
+    /// Flush anything still buffered and return the underlying writer
+    pub fn finish(mut self) -> io::Result<W> {
+        self.out.flush()?;
+        Ok(self.out)
+    }
+}
+
+/// Pass rate of one test group (suite)
+#[derive(Debug, Clone, Serialize)]
+pub struct GroupSummary {
+    pub name: String,
+    pub passed: usize,
+    pub total: usize,
+    pub pass_rate: f64,
+}
+
+/// Group results by suite, keeping suites in first-seen order
+fn group_by_suite(results: &[TestCaseResult]) -> Vec<(&str, Vec<&TestCaseResult>)> {
+    let mut suites: Vec<(&str, Vec<&TestCaseResult>)> = Vec::new();
+    for result in results {
+        match suites.iter_mut().find(|(name, _)| *name == result.suite) {
+            Some((_, cases)) => cases.push(result),
+            None => suites.push((&result.suite, vec![result])),
+        }
+    }
+    suites
+}
+
+// Upper bounds in milliseconds of the timing histogram buckets; a last bucket holds the rest
+const TIMING_BOUNDS: [f64; 3] = [0.1, 1.0, 10.0];
+
+// Slowest tests listed in a report
+const SLOWEST_TESTS: usize = 10;
+
+/// Number of tests whose time fell in a range
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct TimingBucket {
+    /// Range of the bucket, such as `1-10ms`
+    pub range: String,
+    pub count: usize,
+}
+
+/// A test listed among the slowest
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct SlowTest {
+    pub suite: String,
+    pub name: String,
+    pub time_ms: f64,
+}
+
+/// Distribution of test times, leaving out skipped tests
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct TimingSummary {
+    pub histogram: Vec<TimingBucket>,
+    /// Slowest tests, slowest first
+    pub slowest: Vec<SlowTest>,
+}
+
+impl TimingSummary {
+    fn from_results(results: &[TestCaseResult]) -> Self {
+        let timed: Vec<&TestCaseResult> = results
+            .iter()
+            .filter(|r| r.status != TestStatus::Skipped)
+            .collect();
+
+        let mut lower = None;
+        let mut histogram = Vec::new();
+        for upper in TIMING_BOUNDS.iter().copied().map(Some).chain([None]) {
+            let count = timed
+                .iter()
+                .filter(|r| lower.is_none_or(|lower| r.time_ms >= lower))
+                .filter(|r| upper.is_none_or(|upper| r.time_ms < upper))
+                .count();
+            let range = match (lower, upper) {
+                (None, Some(upper)) => format!("<{upper}ms"),
+                (Some(lower), Some(upper)) => format!("{lower}-{upper}ms"),
+                (Some(lower), None) => format!(">={lower}ms"),
+                (None, None) => "all".to_string(),
+            };
+            histogram.push(TimingBucket { range, count });
+            lower = upper;
+        }
+
+        let mut by_time = timed;
+        by_time.sort_by(|a, b| b.time_ms.total_cmp(&a.time_ms));
+        let slowest = by_time
+            .into_iter()
+            .take(SLOWEST_TESTS)
+            .map(|r| SlowTest {
+                suite: r.suite.clone(),
+                name: r.name.clone(),
+                time_ms: r.time_ms,
+            })
+            .collect();
+
+        Self { histogram, slowest }
+    }
+}
+
+/// Output format for a test run report
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, clap::ValueEnum)]
+pub enum ReportFormat {
+    #[default]
+    Json,
+    Junit,
+}
+
+/// A complete test run report
+#[derive(Debug, Clone, Serialize)]
+pub struct TestReport {
+    pub generated_at: String,
+    /// Version of the octofhir-fhirpath engine that produced the results
+    pub engine_version: String,
+    /// Wall-clock time of the whole run in milliseconds
+    pub total_time_ms: f64,
+    /// Wall-clock time spent running test cases; the rest went to setup and I/O
+    pub run_time_ms: f64,
+    pub summary: ReportSummary,
+    /// Per-group pass rates, weakest first
+    pub groups: Vec<GroupSummary>,
+    pub timing: TimingSummary,
+    pub results: Vec<TestCaseResult>,
+}
+
+impl TestReport {
+    pub fn new(results: Vec<TestCaseResult>) -> Self {
+        let mut groups: Vec<GroupSummary> = group_by_suite(&results)
+            .into_iter()
+            .map(|(name, cases)| {
+                let passed = cases
+                    .iter()
+                    .filter(|r| r.status == TestStatus::Passed)
+                    .count();
+                GroupSummary {
+                    name: name.to_string(),
+                    passed,
+                    total: cases.len(),
+                    pass_rate: passed as f64 / cases.len() as f64 * 100.0,
+                }
+            })
+            .collect();
+        groups.sort_by(|a, b| a.pass_rate.total_cmp(&b.pass_rate));
+
+        Self {
+            generated_at: chrono::Utc::now().to_rfc3339(),
+            engine_version: octofhir_fhirpath::VERSION.to_string(),
+            total_time_ms: 0.0,
+            run_time_ms: 0.0,
+            summary: ReportSummary::from_results(&results),
+            groups,
+            timing: TimingSummary::from_results(&results),
+            results,
+        }
+    }
+
+    /// Drop passed and skipped results to keep the report small for triage; the summary,
+    /// groups and timing still cover the whole run
+    pub fn retain_failures(&mut self) {
+        self.results
+            .retain(|r| matches!(r.status, TestStatus::Failed | TestStatus::Error));
+    }
+
+    /// Render the per-group pass rates as an aligned text table
+    pub fn groups_table(&self) -> String {
+        let width = self
+            .groups
+            .iter()
+            .map(|g| g.name.chars().count())
+            .max()
+            .unwrap_or(0)
+            .max("Group".len());
+
+        let mut table = String::new();
+        let _ = writeln!(
+            table,
+            "{:<width$}  {:>11}  {:>7}",
+            "Group", "Passed", "Rate"
+        );
+        for group in &self.groups {
+            let _ = writeln!(
+                table,
+                "{:<width$}  {:>11}  {:>6.1}%",
+                group.name,
+                format!("{}/{}", group.passed, group.total),
+                group.pass_rate
+            );
+        }
+        table
+    }
+
+    /// Render the timing histogram and the slowest tests as text
+    pub fn timing_table(&self) -> String {
+        let timed: usize = self.timing.histogram.iter().map(|b| b.count).sum();
+        let mut table = String::new();
+        for bucket in &self.timing.histogram {
+            let share = if timed == 0 {
+                0.0
+            } else {
+                bucket.count as f64 / timed as f64 * 100.0
+            };
+            let _ = writeln!(
+                table,
+                "{:>9}  {:>6}  {:>5.1}%",
+                bucket.range, bucket.count, share
+            );
+        }
+        if !self.timing.slowest.is_empty() {
+            let _ = writeln!(table, "Slowest:");
+            for test in &self.timing.slowest {
+                let _ = writeln!(
+                    table,
+                    "{:>9.2}ms  {} ({})",
+                    test.time_ms, test.name, test.suite
+                );
+            }
+        }
+        table
+    }
+
+    /// Render the JSON report without the fields that change from run to run (the
+    /// timestamp, times and timing summary), with results sorted by name, so identical
+    /// results give byte-identical files that can be committed as golden files
+    pub fn canonical_json(&self) -> Result<String, serde_json::Error> {
+        let mut report = serde_json::to_value(self)?;
+        if let Value::Object(fields) = &mut report {
+            for volatile in ["generated_at", "total_time_ms", "run_time_ms", "timing"] {
+                fields.remove(volatile);
+            }
+        }
+        if let Some(Value::Array(results)) = report.get_mut("results") {
+            for result in results.iter_mut() {
+                if let Value::Object(fields) = result {
+                    fields.remove("time_ms");
+                }
+            }
+            let key = |r: &Value| (r["name"].to_string(), r["suite"].to_string());
+            results.sort_by_key(key);
+        }
+        serde_json::to_string_pretty(&report)
+    }
+
+    /// Render the report in the requested format
+    pub fn render(&self, format: ReportFormat) -> Result<String, serde_json::Error> {
+        match format {
+            ReportFormat::Json => serde_json::to_string_pretty(self),
+            ReportFormat::Junit => Ok(self.to_junit_xml()),
+        }
+    }
+
+    /// Serialize as JUnit XML, one `<testsuite>` per test suite in first-seen order
+    pub fn to_junit_xml(&self) -> String {
+        let suites = group_by_suite(&self.results);
+
+        let total_time: f64 = self.results.iter().map(|r| r.time_ms).sum::<f64>() / 1000.0;
+        let mut xml = String::from("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n");
+        let _ = writeln!(
+            xml,
+            "<testsuites name=\"octofhir-fhirpath {}\" tests=\"{}\" failures=\"{}\" errors=\"{}\" skipped=\"{}\" time=\"{:.3}\">",
+            self.engine_version,
+            self.summary.total,
+            self.summary.failed,
+            self.summary.errors,
+            self.summary.skipped,
+            total_time
+        );
+
+        for (suite_name, cases) in suites {
+            let summary = ReportSummary::from_results(cases.iter().copied());
+            let suite_time: f64 = cases.iter().map(|r| r.time_ms).sum::<f64>() / 1000.0;
+            let _ = writeln!(
+                xml,
+                "  <testsuite name=\"{}\" tests=\"{}\" failures=\"{}\" errors=\"{}\" skipped=\"{}\" time=\"{:.3}\">",
+                escape(suite_name),
+                summary.total,
+                summary.failed,
+                summary.errors,
+                summary.skipped,
+                suite_time
+            );
+            for case in cases {
+                let _ = write!(
+                    xml,
+                    "    <testcase name=\"{}\" classname=\"{}\" time=\"{:.3}\"",
+                    escape(&case.name),
+                    escape(suite_name),
+                    case.time_ms / 1000.0
+                );
+                let message = escape(case.message.as_deref().unwrap_or_default()).into_owned();
+                match case.status {
+                    TestStatus::Passed => xml.push_str("/>\n"),
+                    TestStatus::Failed => {
+                        let _ = writeln!(
+                            xml,
+                            ">\n      <failure message=\"{message}\">{}</failure>\n    </testcase>",
+                            escape(&case.expression)
+                        );
+                    }
+                    TestStatus::Error => {
+                        let _ = writeln!(
+                            xml,
+                            ">\n      <error message=\"{message}\">{}</error>\n    </testcase>",
+                            escape(&case.expression)
+                        );
+                    }
+                    TestStatus::Skipped => {
+                        let _ = writeln!(
+                            xml,
+                            ">\n      <skipped message=\"{message}\"/>\n    </testcase>"
+                        );
+                    }
+                }
+            }
+            xml.push_str("  </testsuite>\n");
+        }
+
+        xml.push_str("</testsuites>\n");
+        xml
+    }
+}
+
+/// JSON Schema (draft 2020-12) of a report in [`ReportFormat::Json`]
+///
+/// Objects do not allow properties the schema does not list, so a field added to the
+/// report types without a matching schema entry fails the conformance test below.
+pub fn report_schema() -> Value {
+    let count = json!({"type": "integer", "minimum": 0});
+    let millis = json!({"type": "number", "minimum": 0});
+    let status = enum_schema(&[
+        TestStatus::Passed,
+        TestStatus::Failed,
+        TestStatus::Error,
+        TestStatus::Skipped,
+    ]);
+    let skip_reason = enum_schema(&[
+        SkipReason::Disabled,
+        SkipReason::MissingInput,
+        SkipReason::UnsupportedResource,
+    ]);
+    let mismatch = enum_schema(&[
+        MismatchKind::TypeMismatch,
+        MismatchKind::ValueMismatch,
+        MismatchKind::CardinalityMismatch,
+        MismatchKind::WrongError,
+        MismatchKind::CardinalityViolation,
+    ]);
+
+    let summary = object_schema(
+        json!({
+            "total": count,
+            "passed": count,
+            "failed": count,
+            "errors": count,
+            "skipped": count,
+            "skipped_by_reason": {
+                "type": "object",
+                "propertyNames": skip_reason,
+                "additionalProperties": count,
+            },
+            "failed_by_mismatch": {
+                "type": "object",
+                "propertyNames": mismatch,
+                "additionalProperties": count,
+            },
+        }),
+        &["total", "passed", "failed", "errors", "skipped"],
+    );
+    let group = object_schema(
+        json!({
+            "name": {"type": "string"},
+            "passed": count,
+            "total": count,
+            "pass_rate": {"type": "number", "minimum": 0, "maximum": 100},
+        }),
+        &["name", "passed", "total", "pass_rate"],
+    );
+    let timing = object_schema(
+        json!({
+            "histogram": {"type": "array", "items": object_schema(
+                json!({"range": {"type": "string"}, "count": count}),
+                &["range", "count"],
+            )},
+            "slowest": {"type": "array", "items": object_schema(
+                json!({"suite": {"type": "string"}, "name": {"type": "string"}, "time_ms": millis}),
+                &["suite", "name", "time_ms"],
+            )},
+        }),
+        &["histogram", "slowest"],
+    );
+    let trace = object_schema(
+        json!({"label": {"type": "string"}, "index": count, "value": {"type": "string"}}),
+        &["label", "index", "value"],
+    );
+    let result = object_schema(
+        json!({
+            "suite": {"type": "string"},
+            "name": {"type": "string"},
+            "expression": {"type": "string"},
+            "status": status,
+            "message": {"type": "string"},
+            "skip_reason": skip_reason,
+            "mismatch": mismatch,
+            "actual": {"description": "Actual result of a failed comparison, as {type, value} items"},
+            "traces": {"type": "array", "items": trace},
+            "input_hash": {"type": "string"},
+            "time_ms": millis,
+        }),
+        &["suite", "name", "expression", "status", "time_ms"],
+    );
+
+    let mut schema = object_schema(
+        json!({
+            "generated_at": {"type": "string", "format": "date-time"},
+            "engine_version": {"type": "string"},
+            "total_time_ms": millis,
+            "run_time_ms": millis,
+            "summary": summary,
+            "groups": {"type": "array", "items": group},
+            "timing": timing,
+            "results": {"type": "array", "items": result},
+        }),
+        &[
+            "generated_at",
+            "engine_version",
+            "total_time_ms",
+            "run_time_ms",
+            "summary",
+            "groups",
+            "timing",
+            "results",
+        ],
+    );
+    schema["$schema"] = json!("https://json-schema.org/draft/2020-12/schema");
+    schema["title"] = json!("FHIRPath test run report");
+    schema
+}
+
+fn enum_schema<T: Serialize>(variants: &[T]) -> Value {
+    let values: Vec<Value> = variants
+        .iter()
+        .filter_map(|variant| serde_json::to_value(variant).ok())
+        .collect();
+    json!({"type": "string", "enum": values})
+}
+
+fn object_schema(properties: Value, required: &[&str]) -> Value {
+    json!({
+        "type": "object",
+        "properties": properties,
+        "required": required,
+        "additionalProperties": false,
+    })
+}
+
+/// Check up front that a report can be written to `path`, so a run does not do all its
+/// work only to fail at the end; leaves the file system as it was
+pub fn check_writable(path: &Path) -> io::Result<()> {
+    if path.is_dir() {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidInput,
+            "is a directory",
+        ));
+    }
+    if path.exists() {
+        return fs::OpenOptions::new().append(true).open(path).map(|_| ());
+    }
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+    let name = path.file_name().unwrap_or_default().to_string_lossy();
+    let probe = dir.join(format!(".{name}.{}.probe", std::process::id()));
+    fs::File::create(&probe)?;
+    fs::remove_file(&probe)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn result(
+        suite: &str,
+        name: &str,
+        status: TestStatus,
+        message: Option<&str>,
+    ) -> TestCaseResult {
+        TestCaseResult {
+            suite: suite.to_string(),
+            name: name.to_string(),
+            expression: "a < b".to_string(),
+            status,
+            message: message.map(str::to_string),
+            skip_reason: None,
+            mismatch: None,
+            actual: None,
+            traces: Vec::new(),
+            input_hash: None,
+            time_ms: 1500.0,
+        }
+    }
+
+    #[test]
+    fn junit_maps_statuses_to_elements() {
+        let report = TestReport::new(vec![
+            result("math", "testOk", TestStatus::Passed, None),
+            result(
+                "math",
+                "testBad",
+                TestStatus::Failed,
+                Some("index 0: expected 1, actual 2"),
+            ),
+            result(
+                "strings",
+                "testBoom",
+                TestStatus::Error,
+                Some("<eval> failed"),
+            ),
+        ]);
+        let xml = report.to_junit_xml();
+
+        assert!(
+            xml.contains("tests=\"3\" failures=\"1\" errors=\"1\" skipped=\"0\" time=\"4.500\">")
+        );
+        assert!(xml.contains("<testsuite name=\"math\" tests=\"2\" failures=\"1\" errors=\"0\""));
+        assert!(xml.contains("<testcase name=\"testOk\" classname=\"math\" time=\"1.500\"/>"));
+        assert!(
+            xml.contains("<failure message=\"index 0: expected 1, actual 2\">a &lt; b</failure>")
+        );
+        assert!(xml.contains("<error message=\"&lt;eval&gt; failed\">"));
+    }
+
+    #[test]
+    fn summary_counts_skips_by_reason() {
+        let mut skipped = result("math", "testOff", TestStatus::Skipped, Some("disabled"));
+        skipped.skip_reason = Some(SkipReason::Disabled);
+        let mut missing = result("math", "testNoInput", TestStatus::Skipped, None);
+        missing.skip_reason = Some(SkipReason::MissingInput);
+        let report = TestReport::new(vec![skipped.clone(), skipped, missing]);
+
+        let json = serde_json::to_value(&report.summary).unwrap();
+        assert_eq!(json["skipped"], 3);
+        assert_eq!(
+            json["skipped_by_reason"],
+            serde_json::json!({"disabled": 2, "missing_input": 1})
+        );
+    }
+
+    #[test]
+    fn summary_counts_failures_by_mismatch_kind() {
+        let mut wrong_type = result("math", "testType", TestStatus::Failed, None);
+        wrong_type.mismatch = Some(MismatchKind::TypeMismatch);
+        let mut too_many = result("math", "testCount", TestStatus::Failed, None);
+        too_many.mismatch = Some(MismatchKind::CardinalityMismatch);
+        let report = TestReport::new(vec![wrong_type, too_many]);
+
+        let json = serde_json::to_value(&report.summary).unwrap();
+        assert_eq!(
+            json["failed_by_mismatch"],
+            serde_json::json!({"type_mismatch": 1, "cardinality_mismatch": 1})
+        );
+    }
+
+    #[test]
+    fn result_stream_writes_one_line_per_result() {
+        let mut stream = ResultStream::new(Vec::new());
+        stream
+            .push(&result("math", "testOk", TestStatus::Passed, None))
+            .unwrap();
+        stream
+            .push(&result("math", "testBad", TestStatus::Failed, Some("x")))
+            .unwrap();
+        let written = String::from_utf8(stream.finish().unwrap()).unwrap();
+
+        let lines: Vec<serde_json::Value> = written
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 2);
+        assert_eq!(lines[1]["name"], "testBad");
+        assert_eq!(lines[1]["status"], "failed");
+    }
+
+    #[test]
+    fn failures_only_reports_keep_whole_run_counts() {
+        let mut report = TestReport::new(vec![
+            result("math", "testOk", TestStatus::Passed, None),
+            result("math", "testBad", TestStatus::Failed, Some("index 0")),
+            result("math", "testBoom", TestStatus::Error, Some("boom")),
+            result("math", "testOff", TestStatus::Skipped, None),
+        ]);
+        report.retain_failures();
+
+        let names: Vec<&str> = report.results.iter().map(|r| r.name.as_str()).collect();
+        assert_eq!(names, ["testBad", "testBoom"]);
+        assert_eq!(report.summary.total, 4);
+        assert_eq!(report.summary.passed, 1);
+        assert_eq!(report.groups[0].total, 4);
+    }
+
+    #[test]
+    fn canonical_reports_are_byte_stable() {
+        let run = |time_ms| {
+            let mut results = vec![
+                result("strings", "testB", TestStatus::Passed, None),
+                result("math", "testA", TestStatus::Failed, Some("index 0")),
+            ];
+            results.iter_mut().for_each(|r| r.time_ms = time_ms);
+            let mut report = TestReport::new(results);
+            report.total_time_ms = time_ms * 2.0;
+            report.canonical_json().unwrap()
+        };
+
+        let canonical = run(1.5);
+        assert_eq!(canonical, run(20.0));
+        let report: Value = serde_json::from_str(&canonical).unwrap();
+        assert!(report.get("generated_at").is_none());
+        assert!(report.get("timing").is_none());
+        assert_eq!(report["results"][0]["name"], "testA");
+        assert!(report["results"][0].get("time_ms").is_none());
+        assert_eq!(report["summary"]["total"], 2);
+    }
+
+    #[test]
+    fn groups_are_sorted_by_pass_rate() {
+        let report = TestReport::new(vec![
+            result("math", "testOk", TestStatus::Passed, None),
+            result("strings", "testOk", TestStatus::Passed, None),
+            result("strings", "testBad", TestStatus::Failed, None),
+        ]);
+
+        let names: Vec<&str> = report.groups.iter().map(|g| g.name.as_str()).collect();
+        assert_eq!(names, ["strings", "math"]);
+        assert_eq!(report.groups[0].pass_rate, 50.0);
+        assert!(
+            report
+                .groups_table()
+                .contains("strings          1/2    50.0%")
+        );
+    }
+
+    #[test]
+    fn times_are_bucketed_and_the_slowest_listed() {
+        let timed = |name: &str, status, time_ms| TestCaseResult {
+            time_ms,
+            ..result("math", name, status, None)
+        };
+        let report = TestReport::new(vec![
+            timed("testFast", TestStatus::Passed, 0.05),
+            timed("testQuick", TestStatus::Passed, 0.5),
+            timed("testSlow", TestStatus::Failed, 25.0),
+            timed("testEdge", TestStatus::Passed, 10.0),
+            timed("testOff", TestStatus::Skipped, 0.0),
+        ]);
+
+        let histogram: Vec<(&str, usize)> = report
+            .timing
+            .histogram
+            .iter()
+            .map(|b| (b.range.as_str(), b.count))
+            .collect();
+        assert_eq!(
+            histogram,
+            [("<0.1ms", 1), ("0.1-1ms", 1), ("1-10ms", 0), (">=10ms", 2)]
+        );
+        let slowest: Vec<&str> = report
+            .timing
+            .slowest
+            .iter()
+            .map(|t| t.name.as_str())
+            .collect();
+        assert_eq!(slowest, ["testSlow", "testEdge", "testQuick", "testFast"]);
+        assert!(report.timing_table().contains("25.00ms  testSlow (math)"));
+    }
+
+    #[test]
+    fn json_report_includes_summary() {
+        let report = TestReport::new(vec![result("math", "testOk", TestStatus::Passed, None)]);
+        let json: serde_json::Value =
+            serde_json::from_str(&report.render(ReportFormat::Json).unwrap()).unwrap();
+
+        assert_eq!(json["summary"]["passed"], 1);
+        assert_eq!(json["engine_version"], octofhir_fhirpath::VERSION);
+        assert_eq!(json["results"][0]["status"], "passed");
+        assert!(json["results"][0].get("message").is_none());
+    }
+
+    #[test]
+    fn unwritable_report_paths_are_caught_before_writing() {
+        let dir = std::env::temp_dir().join(format!("report-writable-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+
+        let new_file = dir.join("report.json");
+        assert!(check_writable(&new_file).is_ok());
+        assert_eq!(fs::read_dir(&dir).unwrap().count(), 0);
+
+        assert!(check_writable(&dir).is_err());
+        assert!(check_writable(&dir.join("missing").join("report.json")).is_err());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    // Enough of JSON Schema to check the keywords `report_schema` uses
+    fn conforms(schema: &Value, value: &Value) -> bool {
+        let type_ok = match schema.get("type").and_then(Value::as_str) {
+            Some("object") => value.is_object(),
+            Some("array") => value.is_array(),
+            Some("string") => value.is_string(),
+            Some("integer") => value.is_u64() || value.is_i64(),
+            Some("number") => value.is_number(),
+            _ => true,
+        };
+        let enum_ok = schema["enum"]
+            .as_array()
+            .is_none_or(|values| values.contains(value));
+        let items_ok = match (schema.get("items"), value.as_array()) {
+            (Some(items), Some(array)) => array.iter().all(|item| conforms(items, item)),
+            _ => true,
+        };
+        let object_ok = value.as_object().is_none_or(|map| {
+            let required = schema["required"].as_array().cloned().unwrap_or_default();
+            required
+                .iter()
+                .all(|key| map.contains_key(key.as_str().unwrap_or_default()))
+                && map.iter().all(|(key, item)| {
+                    schema
+                        .get("propertyNames")
+                        .is_none_or(|names| conforms(names, &json!(key)))
+                        && match schema["properties"].get(key) {
+                            Some(property) => conforms(property, item),
+                            None => match &schema["additionalProperties"] {
+                                Value::Bool(allowed) => *allowed,
+                                Value::Null => true,
+                                additional => conforms(additional, item),
+                            },
+                        }
+                })
+        });
+        type_ok && enum_ok && items_ok && object_ok
+    }
+
+    #[test]
+    fn reports_conform_to_the_schema() {
+        let mut full = result("math", "testBad", TestStatus::Failed, Some("index 0"));
+        full.mismatch = Some(MismatchKind::ValueMismatch);
+        full.actual = Some(json!([{"type": "integer", "value": 2}]));
+        full.traces = vec![TraceEntry {
+            label: "x".to_string(),
+            index: 0,
+            value: "2".to_string(),
+        }];
+        full.input_hash = Some("0123456789abcdef".to_string());
+        let mut skipped = result("math", "testOff", TestStatus::Skipped, None);
+        skipped.skip_reason = Some(SkipReason::Disabled);
+        let report = TestReport::new(vec![
+            full,
+            skipped,
+            result("strings", "testOk", TestStatus::Passed, None),
+        ]);
+
+        let schema = report_schema();
+        let json = serde_json::to_value(&report).unwrap();
+        assert!(conforms(&schema, &json));
+
+        let mut extra = json.clone();
+        extra["results"][0]["unknown"] = json!(1);
+        assert!(!conforms(&schema, &extra));
+        let mut bad_status = json;
+        bad_status["results"][0]["status"] = json!("flaky");
+        assert!(!conforms(&schema, &bad_status));
+    }
+}
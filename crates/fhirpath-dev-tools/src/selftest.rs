@@ -0,0 +1,263 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Self-test of the result comparison
+//!
+//! Every test verdict goes through the comparison layer, so a regression there silently
+//! flips real outcomes. This runs fixed pairs of expected and actual results, each with a
+//! known verdict, through [`check_result`], which decides the runner's verdicts, and
+//! reports the pairs whose verdict changed.
+
+use crate::report::MismatchKind;
+use crate::runner::{Comparison, check_result};
+use crate::test_support::{Cardinality, TestCase};
+use octofhir_fhirpath::core::PrecisionDateTime;
+use octofhir_fhirpath::core::value_utils::json_to_fhirpath_value;
+use octofhir_fhirpath::evaluator::quantity_utils::parse_string_to_quantity_value;
+use octofhir_fhirpath::{Collection, FhirPathValue};
+use serde_json::{Value, json};
+
+struct SelfTestCase {
+    name: &'static str,
+    expected: Value,
+    /// Items of the evaluated collection, in JSON
+    actual: Value,
+    unordered: bool,
+    /// Declared `outputTypes` of the expected items; actual items declared `dateTime` or
+    /// `Quantity` are read as such
+    output_types: Vec<String>,
+    cardinality: Option<Cardinality>,
+    /// `None` when the pair should pass
+    verdict: Option<MismatchKind>,
+}
+
+fn case(
+    name: &'static str,
+    expected: Value,
+    actual: Value,
+    verdict: Option<MismatchKind>,
+) -> SelfTestCase {
+    SelfTestCase {
+        name,
+        expected,
+        actual,
+        unordered: false,
+        output_types: Vec::new(),
+        cardinality: None,
+        verdict,
+    }
+}
+
+fn typed_case(
+    name: &'static str,
+    output_type: &str,
+    expected: Value,
+    actual: Value,
+    verdict: Option<MismatchKind>,
+) -> SelfTestCase {
+    SelfTestCase {
+        output_types: vec![output_type.to_string()],
+        ..case(name, expected, actual, verdict)
+    }
+}
+
+fn cases() -> Vec<SelfTestCase> {
+    use MismatchKind::{CardinalityMismatch, CardinalityViolation, TypeMismatch, ValueMismatch};
+    vec![
+        case(
+            "equal items",
+            json!([1, "a", true]),
+            json!([1, "a", true]),
+            None,
+        ),
+        case("numbers by value", json!([185]), json!([185.0]), None),
+        case("single expectation", json!(true), json!([true]), None),
+        case("empty expects nothing", json!([]), json!([]), None),
+        case(
+            "empty against an item",
+            json!([]),
+            json!([true]),
+            Some(CardinalityMismatch),
+        ),
+        case(
+            "extra item",
+            json!([1]),
+            json!([1, 1]),
+            Some(CardinalityMismatch),
+        ),
+        case(
+            "different value",
+            json!(["a"]),
+            json!(["b"]),
+            Some(ValueMismatch),
+        ),
+        case(
+            "same text, other type",
+            json!([true]),
+            json!(["true"]),
+            Some(TypeMismatch),
+        ),
+        case(
+            "order matters",
+            json!([1, 2]),
+            json!([2, 1]),
+            Some(ValueMismatch),
+        ),
+        SelfTestCase {
+            unordered: true,
+            ..case("order ignored", json!([1, 2]), json!([2, 1]), None)
+        },
+        case("wildcard", json!(["*"]), json!(["generated-id"]), None),
+        case(
+            "wildcard needs an item",
+            json!(["*"]),
+            json!([]),
+            Some(CardinalityMismatch),
+        ),
+        typed_case(
+            "dateTime at its precision",
+            "dateTime",
+            json!(["2015-02-07T13:28:17Z"]),
+            json!(["2015-02-07T13:28:17+00:00"]),
+            None,
+        ),
+        typed_case(
+            "string keeps its timezone spelling",
+            "string",
+            json!(["2015-02-07T13:28:17Z"]),
+            json!(["2015-02-07T13:28:17+00:00"]),
+            Some(ValueMismatch),
+        ),
+        typed_case(
+            "quantity across units",
+            "Quantity",
+            json!(["1 'm'"]),
+            json!(["100 'cm'"]),
+            None,
+        ),
+        case(
+            "quantity-like strings",
+            json!(["1 'm'"]),
+            json!(["100 'cm'"]),
+            Some(ValueMismatch),
+        ),
+        typed_case(
+            "quantity value",
+            "Quantity",
+            json!(["1 'm'"]),
+            json!(["1 'cm'"]),
+            Some(ValueMismatch),
+        ),
+        typed_case(
+            "declared type checked first",
+            "string",
+            json!(["1"]),
+            json!([1]),
+            Some(TypeMismatch),
+        ),
+        SelfTestCase {
+            cardinality: Some(Cardinality::Singleton),
+            ..case(
+                "cardinality checked first",
+                json!([1, 2]),
+                json!([1, 2]),
+                Some(CardinalityViolation),
+            )
+        },
+    ]
+}
+
+impl SelfTestCase {
+    /// The pair as a test case, expecting its expected items
+    fn test_case(&self) -> TestCase {
+        serde_json::from_value(json!({
+            "name": self.name,
+            "expression": "",
+            "expected": self.expected,
+            "outputTypes": self.output_types,
+            "unordered": self.unordered,
+            "expectedCardinality": self.cardinality,
+        }))
+        .expect("self-test case is a valid test case")
+    }
+
+    /// The actual items as evaluated values
+    fn actual(&self) -> Collection {
+        let items = match &self.actual {
+            Value::Array(items) => items.clone(),
+            single => vec![single.clone()],
+        };
+        let values = items.into_iter().enumerate().map(|(index, item)| {
+            let output_type = self.output_types.get(index).map(String::as_str);
+            let typed = match (output_type, item.as_str()) {
+                (Some("dateTime"), Some(text)) => {
+                    PrecisionDateTime::parse(text).map(FhirPathValue::datetime)
+                }
+                (Some("Quantity"), Some(text)) => parse_string_to_quantity_value(text),
+                _ => None,
+            };
+            typed.unwrap_or_else(|| json_to_fhirpath_value(item))
+        });
+        Collection::from_values(values.collect())
+    }
+}
+
+/// Verdict of the runner on a pair: `None` for a pass, the mismatch kind otherwise
+fn verdict(case: &SelfTestCase) -> Option<MismatchKind> {
+    let (test_case, actual) = (case.test_case(), case.actual());
+    match futures::executor::block_on(check_result(&test_case, &actual, Comparison::Json)) {
+        Ok(mismatch) => mismatch.map(|mismatch| mismatch.kind),
+        // The JSON comparison always runs
+        Err(_) => Some(MismatchKind::ValueMismatch),
+    }
+}
+
+/// Run every self-test pair; returns how many ran and a description of each whose
+/// verdict differs from the known one
+pub fn run_self_test() -> (usize, Vec<String>) {
+    let cases = cases();
+    let describe = |verdict: Option<MismatchKind>| match verdict {
+        Some(kind) => kind.to_string(),
+        None => "pass".to_string(),
+    };
+    let failures = cases
+        .iter()
+        .filter_map(|case| {
+            let got = verdict(case);
+            (got != case.verdict).then(|| {
+                format!(
+                    "{}: expected {}, got {} comparing {} with {}",
+                    case.name,
+                    describe(case.verdict),
+                    describe(got),
+                    case.expected,
+                    case.actual
+                )
+            })
+        })
+        .collect();
+    (cases.len(), failures)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn comparison_verdicts_hold() {
+        let (count, failures) = run_self_test();
+        assert!(count > 0);
+        assert!(failures.is_empty(), "{failures:#?}");
+    }
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Seeded shuffling of test order
+//!
+//! Running tests in a random order surfaces bugs that depend on what ran before. The
+//! order is derived from a seed alone, so a failing order can be replayed exactly.
+
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// SplitMix64, a small generator that is plenty for reordering tests
+struct SplitMix64(u64);
+
+impl SplitMix64 {
+    fn next(&mut self) -> u64 {
+        self.0 = self.0.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = self.0;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        z ^ (z >> 31)
+    }
+}
+
+/// A seed that differs between runs, taken from the clock
+pub fn random_seed() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|elapsed| elapsed.as_nanos() as u64)
+        .unwrap_or_default()
+}
+
+/// Shuffle items in place; the same seed always gives the same order
+pub fn shuffle<T>(items: &mut [T], seed: u64) {
+    let mut rng = SplitMix64(seed);
+    for i in (1..items.len()).rev() {
+        let j = (rng.next() % (i as u64 + 1)) as usize;
+        items.swap(i, j);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn the_same_seed_gives_the_same_order() {
+        let original: Vec<u32> = (0..50).collect();
+        let mut first = original.clone();
+        let mut second = original.clone();
+        shuffle(&mut first, 42);
+        shuffle(&mut second, 42);
+        assert_eq!(first, second);
+        assert_ne!(first, original);
+
+        let mut other = original.clone();
+        shuffle(&mut other, 43);
+        assert_ne!(other, first);
+
+        first.sort();
+        assert_eq!(first, original);
+    }
+}
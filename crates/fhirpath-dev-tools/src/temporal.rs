@@ -0,0 +1,286 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Precision-aware comparison of Date, DateTime and Time results
+//!
+//! Expected values in the test suites are plain strings, while the engine renders
+//! temporal results in its own canonical form. Two values are equal when they have
+//! the same precision and agree on every component down to it. Following FHIRPath,
+//! seconds and milliseconds count as a single precision, so `10:30:00` equals
+//! `10:30:00.000`, while `1974` never equals `1974-12-25`.
+//!
+//! DateTimes with a timezone are compared as instants, so `Z` and `+00:00` are the same
+//! offset and `13:28:17-05:00` equals `18:28:17Z`.
+
+use chrono::{Duration, NaiveDate, NaiveDateTime};
+
+/// Kind of a parsed temporal literal
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TemporalKind {
+    Date,
+    DateTime,
+    Time,
+}
+
+/// A temporal literal split into its components
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TemporalLiteral {
+    pub kind: TemporalKind,
+    /// Year, month, day, hour, minute, second for dates; hour, minute, second for times
+    pub fields: Vec<u32>,
+    /// Fractional seconds in milliseconds, when given
+    pub millis: Option<u32>,
+    /// Timezone offset in minutes east of UTC (`Z` is zero)
+    pub offset_minutes: Option<i32>,
+}
+
+impl TemporalLiteral {
+    /// Parse a FHIRPath or FHIR JSON date, dateTime or time, with or without the `@` prefix
+    pub fn parse(text: &str) -> Option<Self> {
+        let text = text.strip_prefix('@').unwrap_or(text);
+        if let Some(time) = text.strip_prefix('T') {
+            return parse_time(time, true);
+        }
+        if text.len() > 4 && text.as_bytes()[2] == b':' {
+            return parse_time(text, false);
+        }
+        parse_date_time(text)
+    }
+
+    /// The UTC instant of a DateTime with a time of day and a timezone
+    fn utc_instant(&self) -> Option<NaiveDateTime> {
+        if self.kind != TemporalKind::DateTime || self.fields.len() < 4 {
+            return None;
+        }
+        let field = |index: usize| self.fields.get(index).copied().unwrap_or(0);
+        let local = NaiveDate::from_ymd_opt(field(0) as i32, field(1), field(2))?
+            .and_hms_milli_opt(field(3), field(4), field(5), self.millis.unwrap_or(0))?;
+        Some(local - Duration::minutes(i64::from(self.offset_minutes?)))
+    }
+}
+
+/// Compare two strings as temporal values; `None` when either is not a temporal literal
+pub fn temporal_strings_equal(expected: &str, actual: &str) -> Option<bool> {
+    let expected = TemporalLiteral::parse(expected)?;
+    let actual = TemporalLiteral::parse(actual)?;
+
+    let time_kinds = [expected.kind, actual.kind]
+        .iter()
+        .filter(|kind| **kind == TemporalKind::Time)
+        .count();
+    if time_kinds == 1 {
+        return Some(false);
+    }
+
+    // Milliseconds only ever follow seconds, so matching field counts means matching
+    // precision; a missing fraction reads as `.000`
+    if expected.fields.len() != actual.fields.len() {
+        return Some(false);
+    }
+    if let (Some(expected), Some(actual)) = (expected.utc_instant(), actual.utc_instant()) {
+        return Some(expected == actual);
+    }
+    Some(
+        expected.fields == actual.fields
+            && expected.millis.unwrap_or(0) == actual.millis.unwrap_or(0)
+            && expected.offset_minutes == actual.offset_minutes,
+    )
+}
+
+fn parse_number(text: &str, digits: usize) -> Option<u32> {
+    if text.len() == digits && text.bytes().all(|b| b.is_ascii_digit()) {
+        text.parse().ok()
+    } else {
+        None
+    }
+}
+
+/// Parse `.fff` fractional seconds into milliseconds
+fn parse_millis(fraction: &str) -> Option<u32> {
+    if fraction.is_empty() || !fraction.bytes().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+    let mut digits: String = fraction.chars().take(3).collect();
+    while digits.len() < 3 {
+        digits.push('0');
+    }
+    digits.parse().ok()
+}
+
+/// Parse `hh[:mm[:ss[.fff]]]` into fields and milliseconds
+fn parse_clock(text: &str) -> Option<(Vec<u32>, Option<u32>)> {
+    let (clock, fraction) = match text.split_once('.') {
+        Some((clock, fraction)) => (clock, Some(fraction)),
+        None => (text, None),
+    };
+
+    let fields = clock
+        .split(':')
+        .map(|part| parse_number(part, 2))
+        .collect::<Option<Vec<_>>>()?;
+    if fields.is_empty() || fields.len() > 3 || (fraction.is_some() && fields.len() != 3) {
+        return None;
+    }
+
+    let millis = match fraction {
+        Some(fraction) => Some(parse_millis(fraction)?),
+        None => None,
+    };
+    Some((fields, millis))
+}
+
+fn parse_time(text: &str, prefixed: bool) -> Option<TemporalLiteral> {
+    let (fields, millis) = parse_clock(text)?;
+    if !prefixed && fields.len() < 2 {
+        return None;
+    }
+    Some(TemporalLiteral {
+        kind: TemporalKind::Time,
+        fields,
+        millis,
+        offset_minutes: None,
+    })
+}
+
+/// Split a trailing `Z` or `±hh:mm` offset off a time of day
+fn split_offset(text: &str) -> (&str, Option<&str>) {
+    if let Some(clock) = text.strip_suffix('Z') {
+        return (clock, Some("Z"));
+    }
+    match text.rfind(['+', '-']) {
+        Some(index) => (&text[..index], Some(&text[index..])),
+        None => (text, None),
+    }
+}
+
+fn parse_date_time(text: &str) -> Option<TemporalLiteral> {
+    let (date, time) = match text.split_once('T') {
+        Some((date, time)) => (date, Some(time)),
+        None => (text, None),
+    };
+
+    let mut parts = date.split('-');
+    let mut fields = vec![parse_number(parts.next()?, 4)?];
+    for part in parts {
+        fields.push(parse_number(part, 2)?);
+    }
+    if fields.len() > 3 {
+        return None;
+    }
+
+    let Some(time) = time else {
+        return Some(TemporalLiteral {
+            kind: TemporalKind::Date,
+            fields,
+            millis: None,
+            offset_minutes: None,
+        });
+    };
+    if fields.len() != 3 {
+        return None;
+    }
+
+    let (clock, offset) = split_offset(time);
+    let offset_minutes = match offset {
+        None => None,
+        Some("Z") => Some(0),
+        Some(offset) => {
+            let (hours, minutes) = offset[1..].split_once(':')?;
+            let minutes = (parse_number(hours, 2)? * 60 + parse_number(minutes, 2)?) as i32;
+            Some(if offset.starts_with('-') {
+                -minutes
+            } else {
+                minutes
+            })
+        }
+    };
+
+    let mut millis = None;
+    if !clock.is_empty() {
+        let (clock_fields, clock_millis) = parse_clock(clock)?;
+        fields.extend(clock_fields);
+        millis = clock_millis;
+    }
+
+    Some(TemporalLiteral {
+        kind: TemporalKind::DateTime,
+        fields,
+        millis,
+        offset_minutes,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn partial_dates_only_match_at_the_same_precision() {
+        assert_eq!(temporal_strings_equal("1974", "@1974"), Some(true));
+        assert_eq!(temporal_strings_equal("1974-12", "1974-12"), Some(true));
+        assert_eq!(temporal_strings_equal("1974", "1974-12-25"), Some(false));
+        assert_eq!(
+            temporal_strings_equal("1974-12-25", "1974-12-26"),
+            Some(false)
+        );
+    }
+
+    #[test]
+    fn seconds_and_milliseconds_share_a_precision() {
+        assert_eq!(
+            temporal_strings_equal("T10:30:00", "T10:30:00.000"),
+            Some(true)
+        );
+        assert_eq!(
+            temporal_strings_equal("10:30:00.5", "T10:30:00.500"),
+            Some(true)
+        );
+        assert_eq!(temporal_strings_equal("T10:30", "T10:30:00"), Some(false));
+        assert_eq!(
+            temporal_strings_equal(
+                "2014-01-01T08:00:59.999-12:00",
+                "2014-01-01T08:00:59.999-12:00"
+            ),
+            Some(true)
+        );
+    }
+
+    #[test]
+    fn datetimes_with_offsets_compare_as_instants() {
+        assert_eq!(
+            temporal_strings_equal("2015-02-07T13:28:17Z", "2015-02-07T13:28:17+00:00"),
+            Some(true)
+        );
+        assert_eq!(
+            temporal_strings_equal("2015-02-07T13:28:17-05:00", "2015-02-07T18:28:17Z"),
+            Some(true)
+        );
+        assert_eq!(
+            temporal_strings_equal("2015-02-07T13:28:17-05:00", "2015-02-07T13:28:17Z"),
+            Some(false)
+        );
+        assert_eq!(
+            temporal_strings_equal("2015-02-07T13:28:17", "2015-02-07T13:28:17Z"),
+            Some(false)
+        );
+    }
+
+    #[test]
+    fn non_temporal_strings_are_not_compared() {
+        assert_eq!(temporal_strings_equal("hello", "1974"), None);
+        assert_eq!(temporal_strings_equal("12", "12"), None);
+        assert_eq!(temporal_strings_equal("1974-13-45-1", "1974"), None);
+        assert_eq!(temporal_strings_equal("T10:30", "2014-01-01"), Some(false));
+    }
+}
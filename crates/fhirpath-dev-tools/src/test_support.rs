@@ -1,6 +1,20 @@
-use octofhir_fhirpath::Collection;
+use crate::report::MismatchKind;
+use crate::temporal::temporal_strings_equal;
+use chrono::{DateTime, Utc};
+use octofhir_fhirpath::core::value_utils::json_to_fhirpath_value;
+use octofhir_fhirpath::evaluator::OperationEvaluator;
+use octofhir_fhirpath::evaluator::operations::equals_operator::EqualsOperatorEvaluator;
+use octofhir_fhirpath::evaluator::quantity_utils::{
+    are_quantities_equal, parse_string_to_quantity_value,
+};
+use octofhir_fhirpath::{
+    Collection, EvaluationContext, ExpressionNode, FhirPathEngine, FhirPathValue,
+};
+use rust_decimal::Decimal;
 use serde::{Deserialize, Deserializer, Serialize};
-use serde_json::Value;
+use serde_json::{Value, json};
+use std::collections::BTreeMap;
+use std::str::FromStr;
 
 pub fn deserialize_nullable_input<'de, D>(deserializer: D) -> Result<Option<Value>, D::Error>
 where
@@ -10,10 +24,53 @@ where
     Ok(option.map(|v| if v.is_null() { Value::Null } else { v }))
 }
 
+/// A test's expression, or a chain of expressions evaluated in order on the same input
+///
+/// Only the last expression's result is compared with the expected output; earlier ones
+/// set up state, such as variables introduced with `defineVariable()`. The expression
+/// dereferences to that last expression, so single-expression tests read as plain strings.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(untagged)]
+pub enum TestExpression {
+    Single(String),
+    Chain(Vec<String>),
+}
+
+impl TestExpression {
+    /// Expressions evaluated before the one whose result is checked
+    pub fn setup(&self) -> &[String] {
+        match self {
+            Self::Single(_) => &[],
+            Self::Chain(steps) => steps.split_last().map_or(&[], |(_, setup)| setup),
+        }
+    }
+}
+
+impl std::ops::Deref for TestExpression {
+    type Target = str;
+
+    fn deref(&self) -> &str {
+        match self {
+            Self::Single(expression) => expression,
+            Self::Chain(steps) => steps.last().map_or("", String::as_str),
+        }
+    }
+}
+
+impl std::fmt::Display for TestExpression {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Single(expression) => f.write_str(expression),
+            Self::Chain(steps) => f.write_str(&steps.join("; ")),
+        }
+    }
+}
+
 #[derive(Debug, Clone, Deserialize, Serialize)]
 pub struct TestCase {
     pub name: String,
-    pub expression: String,
+    pub expression: TestExpression,
+    /// Inline input resource, used instead of `inputfile` when both are given
     #[serde(default, deserialize_with = "deserialize_nullable_input")]
     pub input: Option<Value>,
     #[serde(skip_serializing_if = "Option::is_none")]
@@ -23,8 +80,16 @@ pub struct TestCase {
     pub tags: Vec<String>,
     #[serde(default)]
     pub description: Option<String>,
+    /// Note for maintainers, such as why the test is disabled; never evaluated, so notes
+    /// stay out of `expression`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub comment: Option<String>,
     #[serde(rename = "expectError", alias = "expecterror")]
     pub expect_error: Option<bool>,
+    /// Text the error of an `expectError` test must contain, so a test failing for some
+    /// other reason does not pass
+    #[serde(rename = "expectedError", skip_serializing_if = "Option::is_none")]
+    pub expected_error: Option<String>,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub disabled: Option<bool>,
     #[serde(default)]
@@ -37,6 +102,43 @@ pub struct TestCase {
     pub mode: Option<String>,
     #[serde(rename = "outputTypes", default)]
     pub output_types: Vec<String>,
+    /// Instant (RFC 3339) that `now()`, `today()` and `timeOfDay()` return for this test
+    #[serde(rename = "fixedNow", skip_serializing_if = "Option::is_none")]
+    pub fixed_now: Option<String>,
+    /// Environment variables available to the expression as `%name`
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub environment: BTreeMap<String, Value>,
+    /// Compare the result as a multiset rather than an ordered list
+    ///
+    /// Meant for expressions whose result order is implementation-defined, such as
+    /// `distinct()` or a union (`|`, `union()`) of several items. Other tests compare in
+    /// order.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub unordered: Option<bool>,
+    /// Expression selecting the single element the main expression is evaluated on
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub focus: Option<String>,
+    /// FHIR type of `inputValue`, such as `string` or `Quantity`
+    #[serde(rename = "inputType", skip_serializing_if = "Option::is_none")]
+    pub input_type: Option<String>,
+    /// Primitive or datatype, in FHIR JSON, to evaluate on instead of a resource; takes
+    /// precedence over `input` and `inputfile`
+    #[serde(rename = "inputValue", skip_serializing_if = "Option::is_none")]
+    pub input_value: Option<Value>,
+    /// Longest the expression may take to evaluate, in milliseconds; a slower evaluation
+    /// fails the test even when the result is right
+    #[serde(rename = "maxTimeMs", skip_serializing_if = "Option::is_none")]
+    pub max_time_ms: Option<f64>,
+    /// Number of items the result must have, checked before its values
+    #[serde(
+        rename = "expectedCardinality",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub expected_cardinality: Option<Cardinality>,
+    /// FHIR version of the model this test is evaluated against (`r4`, `r4b`, `r5`,
+    /// `r6`), overriding the run's `--fhir-version`
+    #[serde(rename = "fhirVersion", skip_serializing_if = "Option::is_none")]
+    pub fhir_version: Option<String>,
     // New fields for organized test structure
     #[serde(skip_serializing_if = "Option::is_none")]
     pub category: Option<String>,
@@ -44,6 +146,77 @@ pub struct TestCase {
     pub subcategory: Option<String>,
 }
 
+impl TestCase {
+    /// Whether the result may come back in any order
+    pub fn is_unordered(&self) -> bool {
+        self.unordered.unwrap_or(false)
+    }
+
+    /// Check the error an `expectError` test failed with against its `expectedError`,
+    /// describing a failure for another reason
+    pub fn check_error(&self, error: &str) -> Result<(), String> {
+        match &self.expected_error {
+            Some(expected) if !error.contains(expected.as_str()) => Err(format!(
+                "Failed for another reason: expected an error containing \"{expected}\", got: {error}"
+            )),
+            _ => Ok(()),
+        }
+    }
+
+    /// Check the size of a result against the test's `expectedCardinality`
+    pub fn check_cardinality(&self, count: usize) -> Result<(), String> {
+        match self.expected_cardinality {
+            Some(cardinality) if !cardinality.allows(count) => Err(format!(
+                "Cardinality violation: expected {cardinality}, got {count} items"
+            )),
+            _ => Ok(()),
+        }
+    }
+
+    /// Resource holding the test's typed input (see [`typed_input_resource`]), if it has one
+    pub fn typed_input(&self) -> Option<Result<Value, String>> {
+        match (&self.input_type, &self.input_value) {
+            (Some(input_type), Some(value)) => Some(typed_input_resource(input_type, value)),
+            (None, None) => None,
+            _ => Some(Err(
+                "inputType and inputValue must be given together".to_string()
+            )),
+        }
+    }
+}
+
+/// How many items a result may have, whatever their values
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Cardinality {
+    /// Exactly one item
+    Singleton,
+    /// At most one item
+    Optional,
+    /// Any number of items
+    Collection,
+}
+
+impl Cardinality {
+    pub fn allows(self, count: usize) -> bool {
+        match self {
+            Self::Singleton => count == 1,
+            Self::Optional => count <= 1,
+            Self::Collection => true,
+        }
+    }
+}
+
+impl std::fmt::Display for Cardinality {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            Self::Singleton => "exactly one item",
+            Self::Optional => "at most one item",
+            Self::Collection => "any number of items",
+        })
+    }
+}
+
 #[derive(Debug, Clone, Deserialize, Serialize)]
 pub struct TestSuite {
     pub name: String,
@@ -57,6 +230,159 @@ pub struct TestSuite {
     pub category: Option<String>,
 }
 
+/// Match a `--filter` pattern against a test or suite name
+///
+/// Patterns containing `*` or `?` are treated as globs matched against the whole name;
+/// anything else is a plain substring match.
+pub fn matches_filter(pattern: &str, text: &str) -> bool {
+    if pattern.contains(['*', '?']) {
+        glob_match(pattern.as_bytes(), text.as_bytes())
+    } else {
+        text.contains(pattern)
+    }
+}
+
+fn glob_match(pattern: &[u8], text: &[u8]) -> bool {
+    match pattern.split_first() {
+        None => text.is_empty(),
+        Some((b'*', rest)) => (0..=text.len()).any(|i| glob_match(rest, &text[i..])),
+        Some((b'?', rest)) => !text.is_empty() && glob_match(rest, &text[1..]),
+        Some((c, rest)) => text.first() == Some(c) && glob_match(rest, &text[1..]),
+    }
+}
+
+/// Normalize the whitespace of an expression read from the XML test definitions
+///
+/// Surrounding whitespace is trimmed and each run of whitespace between tokens becomes a
+/// single space, or a single newline when it spans lines so `//` comments still end where
+/// they did. String literals and delimited identifiers are copied unchanged.
+pub fn normalize_expression(expression: &str) -> String {
+    let mut normalized = String::with_capacity(expression.len());
+    let mut chars = expression.trim().chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\'' | '`' => {
+                normalized.push(c);
+                while let Some(inner) = chars.next() {
+                    normalized.push(inner);
+                    if inner == '\\' {
+                        normalized.extend(chars.next());
+                    } else if inner == c {
+                        break;
+                    }
+                }
+            }
+            c if c.is_whitespace() => {
+                let mut newline = c == '\n';
+                while let Some(&next) = chars.peek() {
+                    if !next.is_whitespace() {
+                        break;
+                    }
+                    newline |= next == '\n';
+                    chars.next();
+                }
+                normalized.push(if newline { '\n' } else { ' ' });
+            }
+            c => normalized.push(c),
+        }
+    }
+    normalized
+}
+
+/// Evaluation mode requested by a test case's `mode` attribute
+///
+/// Recognized values are `lenient` (the default when no mode is given) and `strict`,
+/// which statically checks the expression with semantic analysis before evaluating it.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TestMode {
+    Lenient,
+    Strict,
+}
+
+impl TestMode {
+    /// Parse a mode attribute, returning the unrecognized value as the error
+    pub fn parse(mode: Option<&str>) -> Result<Self, String> {
+        match mode.map(str::trim) {
+            None | Some("") => Ok(Self::Lenient),
+            Some(m) if m.eq_ignore_ascii_case("lenient") => Ok(Self::Lenient),
+            Some(m) if m.eq_ignore_ascii_case("strict") => Ok(Self::Strict),
+            Some(other) => Err(other.to_string()),
+        }
+    }
+}
+
+/// Convert a test's environment map into evaluation context variables
+///
+/// Names may be given with or without the leading `%`; values follow the usual JSON
+/// mapping (strings, integers, decimals, booleans, and objects as resources).
+pub fn environment_variables(
+    environment: &BTreeMap<String, Value>,
+) -> Vec<(String, FhirPathValue)> {
+    environment
+        .iter()
+        .map(|(name, value)| {
+            let name = name.strip_prefix('%').unwrap_or(name).to_string();
+            (name, json_to_fhirpath_value(value.clone()))
+        })
+        .collect()
+}
+
+/// `%resource` and `%rootResource` for a test input
+///
+/// Test inputs are always top-level resources, so both refer to the input itself, also
+/// when it is a Bundle or carries contained resources. Inputs that are not resources get
+/// neither variable.
+pub fn resource_variables(input: &FhirPathValue) -> Vec<(String, FhirPathValue)> {
+    if !matches!(input, FhirPathValue::Resource(..)) {
+        return Vec::new();
+    }
+    vec![
+        ("resource".to_string(), input.clone()),
+        ("rootResource".to_string(), input.clone()),
+    ]
+}
+
+/// Instant that `now()`, `today()` and `timeOfDay()` observe during a test run
+///
+/// Read from `FHIRPATH_TEST_NOW` (RFC 3339) when set, otherwise the current time, so
+/// every test in a run sees the same clock and failures can be replayed.
+pub fn test_clock() -> Result<DateTime<Utc>, String> {
+    match std::env::var("FHIRPATH_TEST_NOW") {
+        Ok(value) => parse_instant(&value).map_err(|e| format!("Invalid FHIRPATH_TEST_NOW {e}")),
+        Err(_) => Ok(Utc::now()),
+    }
+}
+
+/// Parse an RFC 3339 instant such as a test's `fixedNow`
+pub fn parse_instant(value: &str) -> Result<DateTime<Utc>, String> {
+    DateTime::parse_from_rfc3339(value)
+        .map(|now| now.with_timezone(&Utc))
+        .map_err(|e| format!("'{value}': {e}"))
+}
+
+/// Render a parsed expression as an indented JSON tree, leaving out source locations
+pub fn ast_dump(ast: &ExpressionNode) -> String {
+    serde_json::to_string_pretty(&ast_tree(ast)).unwrap_or_default()
+}
+
+/// Convert a parsed expression to a JSON tree without source locations
+pub fn ast_tree(ast: &ExpressionNode) -> Value {
+    let mut tree = serde_json::to_value(ast).unwrap_or(Value::Null);
+    strip_locations(&mut tree);
+    tree
+}
+
+fn strip_locations(value: &mut Value) {
+    match value {
+        Value::Object(map) => {
+            map.remove("location");
+            map.values_mut().for_each(strip_locations);
+        }
+        Value::Array(items) => items.iter_mut().for_each(strip_locations),
+        _ => {}
+    }
+}
+
 pub fn normalize_type_name(name: &str) -> String {
     name.trim().to_ascii_lowercase()
 }
@@ -73,14 +399,23 @@ pub struct TypeMismatch {
     pub actual: Vec<String>,
 }
 
-pub fn verify_output_types(expected: &[String], actual: &Collection) -> Result<(), TypeMismatch> {
+/// Check the result's types against the declared output types, in order unless `unordered`
+pub fn verify_output_types(
+    expected: &[String],
+    actual: &Collection,
+    unordered: bool,
+) -> Result<(), TypeMismatch> {
     if expected.is_empty() {
         return Ok(());
     }
 
     let actual_raw = collect_type_names(actual);
-    let actual_norm: Vec<String> = actual_raw.iter().map(|t| normalize_type_name(t)).collect();
-    let expected_norm: Vec<String> = expected.iter().map(|t| normalize_type_name(t)).collect();
+    let mut actual_norm: Vec<String> = actual_raw.iter().map(|t| normalize_type_name(t)).collect();
+    let mut expected_norm: Vec<String> = expected.iter().map(|t| normalize_type_name(t)).collect();
+    if unordered {
+        actual_norm.sort();
+        expected_norm.sort();
+    }
 
     if actual_norm == expected_norm {
         Ok(())
@@ -92,58 +427,1058 @@ pub fn verify_output_types(expected: &[String], actual: &Collection) -> Result<(
     }
 }
 
-pub fn compare_results(expected: &Value, actual: &Collection) -> bool {
-    let actual_json = match serde_json::to_value(actual) {
-        Ok(json) => json,
-        Err(_) => return false,
+/// Expected output item that matches any single actual item
+///
+/// Meant for volatile values such as generated ids; the item's declared output type is
+/// still checked. Only whole items of the expected collection are wildcards; a `"*"`
+/// inside an expected object or list is the string itself.
+pub const WILDCARD: &str = "*";
+
+/// Whether an expected item is the [`WILDCARD`]
+pub fn is_wildcard(value: &Value) -> bool {
+    value.as_str() == Some(WILDCARD)
+}
+
+/// Compare JSON values treating numbers by exact decimal value, so `185`, `185.0` and
+/// `1.85e2` are equal while integers past the precision of a float stay distinct.
+pub fn json_values_equal(expected: &Value, actual: &Value) -> bool {
+    match (expected, actual) {
+        (Value::Number(a), Value::Number(b)) => match (a.as_i64(), b.as_i64()) {
+            (Some(a), Some(b)) => a == b,
+            _ => match (json_decimal(a), json_decimal(b)) {
+                (Some(a), Some(b)) => a == b,
+                _ => a == b,
+            },
+        },
+        (Value::String(a), Value::String(b)) => a == b,
+        (Value::Array(a), Value::Array(b)) => {
+            a.len() == b.len() && a.iter().zip(b).all(|(a, b)| json_values_equal(a, b))
+        }
+        (Value::Object(a), Value::Object(b)) => {
+            a.len() == b.len()
+                && a.iter().all(|(key, value)| {
+                    b.get(key)
+                        .is_some_and(|other| json_values_equal(value, other))
+                })
+        }
+        _ => expected == actual,
+    }
+}
+
+/// Exact value of a JSON number, read from its text with trailing zeros dropped; `None`
+/// beyond the range of a decimal
+fn json_decimal(number: &serde_json::Number) -> Option<Decimal> {
+    let text = number.to_string();
+    let value = if text.contains(['e', 'E']) {
+        Decimal::from_scientific(&text)
+    } else {
+        Decimal::from_str(&text)
     };
+    value.ok().map(|value| value.normalize())
+}
 
-    if expected == &actual_json {
+/// Compare an expected item of a collection with an actual one as their declared output
+/// type reads them
+///
+/// An expected [`WILDCARD`] equals any single item. Items declared `date`, `dateTime` or
+/// `time` compare by their components at their precision (see [`crate::temporal`]), and
+/// items declared `Quantity` after UCUM conversion (see [`quantities_equal`]); anything
+/// else, strings included, compares as [`json_values_equal`] does.
+pub fn items_equal(expected: &Value, actual: &Value, output_type: Option<&str>) -> bool {
+    if is_wildcard(expected) {
+        return !actual.is_array() && !actual.is_null();
+    }
+    if json_values_equal(expected, actual) {
         return true;
     }
+    match (output_type, expected, actual) {
+        (Some("date" | "dateTime" | "time"), Value::String(a), Value::String(b)) => {
+            temporal_strings_equal(a, b).unwrap_or(false)
+        }
+        (Some("Quantity"), _, _) => quantities_equal(expected, actual),
+        _ => false,
+    }
+}
 
-    match (expected, &actual_json) {
-        (expected_single, actual_json) if actual_json.is_array() => {
-            if let Some(actual_arr) = actual_json.as_array() {
-                if actual_arr.len() == 1 {
-                    expected_single == &actual_arr[0]
-                } else {
-                    false
-                }
-            } else {
-                false
+/// The `outputTypes` entry for the item at `index`, if the test declares one
+pub fn declared_type(output_types: &[String], index: usize) -> Option<&str> {
+    output_types.get(index).map(String::as_str)
+}
+
+/// Compare two quantities after UCUM conversion, so `1 'm'` equals `100 'cm'`
+///
+/// Either side may be in literal string form or the structured form of
+/// [`quantity_to_json`]. Values that are not quantities, and units that do not convert
+/// into each other, are unequal.
+pub fn quantities_equal(expected: &Value, actual: &Value) -> bool {
+    let (
+        Some(FhirPathValue::Quantity {
+            value: left_value,
+            unit: left_unit,
+            calendar_unit: left_calendar_unit,
+            ..
+        }),
+        Some(FhirPathValue::Quantity {
+            value: right_value,
+            unit: right_unit,
+            calendar_unit: right_calendar_unit,
+            ..
+        }),
+    ) = (json_quantity(expected), json_quantity(actual))
+    else {
+        return false;
+    };
+    are_quantities_equal(
+        left_value,
+        &left_unit,
+        &left_calendar_unit,
+        right_value,
+        &right_unit,
+        &right_calendar_unit,
+    )
+    .unwrap_or(false)
+}
+
+/// Quantity from its literal string form or its `{value, unit, system, code}` form;
+/// bare numbers are not taken as unitless quantities
+fn json_quantity(value: &Value) -> Option<FhirPathValue> {
+    let literal = match value {
+        Value::String(text) if text.trim().parse::<f64>().is_err() => text.clone(),
+        Value::Object(map) => {
+            let amount = map.get("value").filter(|v| v.is_number())?;
+            let system = map.get("system").and_then(Value::as_str);
+            match (map.get("code").and_then(Value::as_str), system) {
+                (Some(code), None | Some(UCUM_SYSTEM)) => format!("{amount} '{code}'"),
+                (None, None) => format!("{amount} {}", map.get("unit")?.as_str()?),
+                _ => return None,
             }
         }
-        (expected, actual_single) if expected.is_array() => {
-            if let Some(expected_arr) = expected.as_array() {
-                if expected_arr.len() == 1 {
-                    &expected_arr[0] == actual_single
-                } else {
-                    expected == actual_single
+        _ => return None,
+    };
+    parse_string_to_quantity_value(&literal)
+}
+
+const UCUM_SYSTEM: &str = "http://unitsofmeasure.org";
+
+/// Structured `{value, unit, system, code}` form of a Quantity result
+///
+/// The value keeps the decimal's own precision, and quantities written with a UCUM
+/// unit get the UCUM system and code filled in. Calendar durations carry only a unit.
+pub fn quantity_to_json(value: &FhirPathValue) -> Option<Value> {
+    let FhirPathValue::Quantity {
+        value,
+        unit,
+        code,
+        system,
+        calendar_unit,
+        ..
+    } = value
+    else {
+        return None;
+    };
+
+    let text = value.to_string();
+    let mut map = serde_json::Map::new();
+    map.insert(
+        "value".to_string(),
+        serde_json::from_str(&text).unwrap_or(Value::String(text)),
+    );
+    if let Some(unit) = unit {
+        map.insert("unit".to_string(), Value::String(unit.clone()));
+    }
+
+    let code = code
+        .clone()
+        .or_else(|| unit.clone().filter(|_| calendar_unit.is_none()));
+    let system = system
+        .clone()
+        .or_else(|| code.as_ref().map(|_| UCUM_SYSTEM.to_string()));
+    if let Some(system) = system {
+        map.insert("system".to_string(), Value::String(system));
+    }
+    if let Some(code) = code {
+        map.insert("code".to_string(), Value::String(code));
+    }
+
+    Some(Value::Object(map))
+}
+
+/// Serialize an evaluated collection for comparison against the expected result
+///
+/// Quantities are emitted in their literal string form (`5 'mg'`) unless the expected
+/// item at the same index is an object, in which case the structured form from
+/// [`quantity_to_json`] is used, tagged with `type` when the expectation has one.
+pub fn result_to_json(expected: &Value, actual: &Collection) -> serde_json::Result<Value> {
+    let has_quantity = actual
+        .iter()
+        .any(|item| matches!(item, FhirPathValue::Quantity { .. }));
+    if !has_quantity {
+        return serde_json::to_value(actual);
+    }
+
+    let expected_items = result_items(expected);
+    let mut items = Vec::new();
+    for (index, item) in actual.iter().enumerate() {
+        let expected_item = expected_items.get(index).and_then(|v| v.as_object());
+        match (expected_item, quantity_to_json(item)) {
+            (Some(expected_item), Some(Value::Object(mut quantity))) => {
+                if let Some(kind) = expected_item.get("type") {
+                    quantity.insert("type".to_string(), kind.clone());
                 }
-            } else {
-                false
+                items.push(Value::Object(quantity));
             }
+            _ => items.push(serde_json::to_value(item)?),
         }
-        (expected, actual_json) if expected.is_array() && actual_json.is_null() => expected
-            .as_array()
-            .map(|arr| arr.is_empty())
-            .unwrap_or(false),
-        (expected, actual_json) if expected.is_null() && actual_json.is_array() => actual_json
-            .as_array()
-            .map(|arr| arr.is_empty())
-            .unwrap_or(false),
-        (expected, actual_single) if expected.is_array() => {
-            if let Some(expected_arr) = expected.as_array() {
-                if expected_arr.len() == 1 {
-                    &expected_arr[0] == actual_single
-                } else {
-                    false
+    }
+    Ok(Value::Array(items))
+}
+
+/// Tag each item of a serialized result with its FHIRPath type name, as `{type, value}`
+/// objects, so `true` and `"true"` read differently; items past the end of `types` keep
+/// only their value
+pub fn typed_items(values: &Value, types: &[String]) -> Value {
+    let items = result_items(values)
+        .into_iter()
+        .enumerate()
+        .map(|(index, value)| {
+            let mut item = serde_json::Map::new();
+            if let Some(kind) = types.get(index) {
+                item.insert("type".to_string(), Value::String(kind.clone()));
+            }
+            item.insert("value".to_string(), value.clone());
+            Value::Object(item)
+        })
+        .collect();
+    Value::Array(items)
+}
+
+/// Short fingerprint of a test's input data
+///
+/// Hashes the input's JSON with its keys in sorted order (FNV-1a, 64 bits), so the same
+/// resource gives the same fingerprint on every run and platform whether it came from a
+/// JSON file, an XML file or inline. Two runs with different fingerprints for a test did
+/// not evaluate it against the same data.
+pub fn input_fingerprint(input: &Value) -> String {
+    stable_hash(&serde_json::to_vec(input).unwrap_or_default())
+}
+
+/// FNV-1a hash of `bytes` as 16 hex digits, the same on every run and platform
+pub fn stable_hash(bytes: &[u8]) -> String {
+    let hash = bytes.iter().fold(0xcbf2_9ce4_8422_2325_u64, |hash, byte| {
+        (hash ^ u64::from(*byte)).wrapping_mul(0x0000_0100_0000_01b3)
+    });
+    format!("{hash:016x}")
+}
+
+/// Serialize one evaluated item for a report
+///
+/// Numbers follow one contract so reports from different runs diff cleanly: integers are
+/// JSON numbers, and decimals are strings in their own notation, keeping their scale
+/// (`1.50` stays `"1.50"`) where a JSON number would go through a float. Other values
+/// serialize as usual.
+pub fn report_value(item: &FhirPathValue) -> Value {
+    match item {
+        FhirPathValue::Integer(value, _, _) => Value::from(*value),
+        FhirPathValue::Decimal(value, _, _) => Value::String(value.to_string()),
+        other => serde_json::to_value(other).unwrap_or(Value::Null),
+    }
+}
+
+/// An evaluated collection as `{type, value}` items for a report, with values from
+/// [`report_value`]
+pub fn typed_result(actual: &Collection) -> Value {
+    let values = Value::Array(actual.iter().map(report_value).collect());
+    typed_items(&values, &collect_type_names(actual))
+}
+
+/// Type names of the items tagged by [`typed_items`]
+pub fn item_types(typed: &Value) -> Vec<String> {
+    result_items(typed)
+        .into_iter()
+        .filter_map(|item| item.get("type")?.as_str().map(str::to_string))
+        .collect()
+}
+
+/// Compare an evaluated collection with the expected result item by item, in order
+///
+/// Each item is compared as the `outputTypes` entry at its position declares it (see
+/// [`items_equal`]).
+pub fn compare_results(expected: &Value, actual: &Collection, output_types: &[String]) -> bool {
+    // A test without outputs expects an empty collection and nothing else
+    let expected_items = result_items(expected);
+    if expected_items.is_empty() {
+        return actual.is_empty();
+    }
+
+    let Ok(actual_json) = result_to_json(expected, actual) else {
+        return false;
+    };
+    let actual_items = result_items(&actual_json);
+    expected_items.len() == actual_items.len()
+        && expected_items
+            .iter()
+            .zip(&actual_items)
+            .enumerate()
+            .all(|(index, (e, a))| items_equal(e, a, declared_type(output_types, index)))
+}
+
+/// Compare an evaluated collection with the expected result as multisets, ignoring order
+///
+/// Each expected item is compared as the `outputTypes` entry at its position declares it.
+pub fn compare_results_unordered(
+    expected: &Value,
+    actual: &Collection,
+    output_types: &[String],
+) -> bool {
+    let Ok(actual_json) = result_to_json(expected, actual) else {
+        return false;
+    };
+    let expected_items = result_items(expected);
+    let actual_items = result_items(&actual_json);
+    if expected_items.len() != actual_items.len() {
+        return false;
+    }
+
+    // Wildcards go last so they do not take items a specific expectation needs
+    let (wildcards, specific): (Vec<_>, Vec<_>) = expected_items
+        .into_iter()
+        .enumerate()
+        .partition(|(_, item)| is_wildcard(item));
+    let mut matched = vec![false; actual_items.len()];
+    specific
+        .iter()
+        .chain(&wildcards)
+        .all(|(position, expected_item)| {
+            let output_type = declared_type(output_types, *position);
+            let found = actual_items
+                .iter()
+                .enumerate()
+                .position(|(index, actual_item)| {
+                    !matched[index] && items_equal(expected_item, actual_item, output_type)
+                });
+            match found {
+                Some(index) => {
+                    matched[index] = true;
+                    true
                 }
+                None => false,
+            }
+        })
+}
+
+/// Flatten an expected or actual JSON result into its collection items
+pub fn result_items(value: &Value) -> Vec<&Value> {
+    match value {
+        Value::Null => Vec::new(),
+        Value::Array(items) => items.iter().collect(),
+        single => vec![single],
+    }
+}
+
+/// Classify how an actual JSON result differs from the expected one; `None` when they match
+///
+/// Collections of different sizes are cardinality mismatches. Otherwise the first
+/// differing item decides: a type mismatch when both render to the same text (`true`
+/// against `"true"`, `1` against `"1"`), a value mismatch for anything else.
+pub fn classify_mismatch(
+    expected: &Value,
+    actual: &Value,
+    output_types: &[String],
+) -> Option<MismatchKind> {
+    let expected_items = result_items(expected);
+    let actual_items = result_items(actual);
+    if expected_items.len() != actual_items.len() {
+        return Some(MismatchKind::CardinalityMismatch);
+    }
+
+    let (_, (expected_item, actual_item)) = expected_items
+        .into_iter()
+        .zip(actual_items)
+        .enumerate()
+        .find(|(index, (e, a))| !items_equal(e, a, declared_type(output_types, *index)))?;
+    let as_text = |value: &Value| match value {
+        Value::String(s) => Some(s.clone()),
+        Value::Bool(_) | Value::Number(_) => Some(value.to_string()),
+        _ => None,
+    };
+    let same_kind = std::mem::discriminant(expected_item) == std::mem::discriminant(actual_item);
+    match (as_text(expected_item), as_text(actual_item)) {
+        (Some(e), Some(a)) if !same_kind && e == a => Some(MismatchKind::TypeMismatch),
+        _ => Some(MismatchKind::ValueMismatch),
+    }
+}
+
+/// Describe the first difference between an expected result and an evaluated collection
+pub fn describe_mismatch(
+    expected: &Value,
+    actual: &Collection,
+    output_types: &[String],
+) -> Option<String> {
+    match result_to_json(expected, actual) {
+        Ok(actual_json) => describe_json_mismatch(expected, &actual_json, output_types),
+        Err(e) => Some(format!("Failed to serialize actual result: {e}")),
+    }
+}
+
+/// Walk both collections in order and report the first index where they differ
+pub fn describe_json_mismatch(
+    expected: &Value,
+    actual: &Value,
+    output_types: &[String],
+) -> Option<String> {
+    let expected_items = result_items(expected);
+    let actual_items = result_items(actual);
+
+    if expected_items.is_empty() && !actual_items.is_empty() {
+        let unexpected: Vec<String> = actual_items.iter().map(|v| v.to_string()).collect();
+        return Some(format!(
+            "expected an empty collection, actual {} unexpected item(s): {}",
+            unexpected.len(),
+            unexpected.join(", ")
+        ));
+    }
+
+    for (index, (expected_item, actual_item)) in
+        expected_items.iter().zip(actual_items.iter()).enumerate()
+    {
+        if !items_equal(
+            expected_item,
+            actual_item,
+            declared_type(output_types, index),
+        ) {
+            return Some(format!(
+                "index {index}: expected {expected_item}, actual {actual_item}"
+            ));
+        }
+    }
+
+    if expected_items.len() != actual_items.len() {
+        return Some(format!(
+            "expected {} item(s), actual {} item(s)",
+            expected_items.len(),
+            actual_items.len()
+        ));
+    }
+
+    None
+}
+
+/// Evaluate a test's `focus` expression and return a context focused on its result
+///
+/// The focus must select exactly one element. Variables and `%resource` are inherited
+/// from the given context.
+pub async fn focus_context(
+    engine: &FhirPathEngine,
+    context: &EvaluationContext,
+    focus: &str,
+) -> Result<EvaluationContext, String> {
+    let focused = engine
+        .evaluate(focus, context)
+        .await
+        .map_err(|e| format!("Failed to evaluate focus `{focus}`: {e}"))?
+        .value;
+    if focused.len() != 1 {
+        return Err(format!(
+            "Focus `{focus}` selected {} elements, expected exactly one",
+            focused.len()
+        ));
+    }
+    Ok(context.create_child_context(focused))
+}
+
+/// Focus selecting the typed input inside a resource from [`typed_input_resource`]
+pub const TYPED_INPUT_FOCUS: &str = "parameter.value";
+
+/// Wrap a primitive or datatype value in a Parameters resource
+///
+/// The open `value[x]` element of a parameter takes any datatype, so the model provider
+/// types the value as `input_type` just as it would inside a real resource. Evaluate
+/// [`TYPED_INPUT_FOCUS`] on the resource to get the element itself.
+pub fn typed_input_resource(input_type: &str, value: &Value) -> Result<Value, String> {
+    let mut chars = input_type.chars();
+    let first = chars
+        .next()
+        .filter(|_| input_type.chars().all(|c| c.is_ascii_alphanumeric()))
+        .ok_or_else(|| format!("Invalid inputType '{input_type}'"))?;
+    let key = format!("value{}{}", first.to_ascii_uppercase(), chars.as_str());
+    Ok(json!({
+        "resourceType": "Parameters",
+        "parameter": [{ "name": "input", key: value }],
+    }))
+}
+
+/// How evaluated results are checked against expected outputs
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, clap::ValueEnum)]
+pub enum CompareMode {
+    /// Compare the JSON rendering of the result with the expected JSON
+    #[default]
+    Json,
+    /// Compare library values with the engine's `=` against expected literals
+    Native,
+}
+
+/// Write an expected result item as a FHIRPath literal, guided by its declared output type
+///
+/// Returns `None` for items that have no literal form, such as resources.
+pub fn expected_literal(item: &Value, output_type: Option<&str>) -> Option<String> {
+    match item {
+        Value::Bool(b) => Some(b.to_string()),
+        Value::Number(n) => {
+            let text = n.to_string();
+            if output_type == Some("decimal") && !text.contains(['.', 'e', 'E']) {
+                Some(format!("{text}.0"))
             } else {
-                false
+                Some(text)
             }
         }
-        _ => false,
+        Value::String(s) => Some(match output_type {
+            Some("date" | "dateTime") if !s.starts_with('@') => format!("@{s}"),
+            Some("time") if !s.starts_with('@') => format!("@T{}", s.trim_start_matches('T')),
+            Some("boolean" | "integer" | "decimal" | "Quantity" | "date" | "dateTime" | "time") => {
+                s.clone()
+            }
+            _ => format!("'{}'", s.replace('\\', "\\\\").replace('\'', "\\'")),
+        }),
+        Value::Object(quantity) => {
+            let value = quantity.get("value")?;
+            let unit = quantity
+                .get("code")
+                .or_else(|| quantity.get("unit"))
+                .and_then(Value::as_str)?;
+            Some(format!("{value} '{unit}'"))
+        }
+        _ => None,
+    }
+}
+
+/// Compare an evaluated collection against the expected result using the engine's own `=`
+///
+/// Each expected item is turned back into a FHIRPath literal and evaluated, so the
+/// comparison runs on library values rather than on their JSON rendering. With
+/// `unordered`, each actual item may match any expected item not matched yet.
+pub async fn compare_native(
+    engine: &FhirPathEngine,
+    context: &EvaluationContext,
+    expected: &Value,
+    output_types: &[String],
+    actual: &Collection,
+    unordered: bool,
+) -> Result<bool, String> {
+    let expected_items = result_items(expected);
+    if expected_items.len() != actual.len() {
+        return Ok(false);
+    }
+
+    // `None` stands for a wildcard, which matches any item
+    let mut expected_values = Vec::with_capacity(expected_items.len());
+    for (index, item) in expected_items.iter().enumerate() {
+        if is_wildcard(item) {
+            expected_values.push(None);
+            continue;
+        }
+        let literal = expected_literal(item, output_types.get(index).map(String::as_str))
+            .ok_or_else(|| format!("index {index}: no FHIRPath literal for expected {item}"))?;
+        let value = engine
+            .evaluate(&literal, context)
+            .await
+            .map_err(|e| format!("index {index}: failed to evaluate `{literal}`: {e}"))?
+            .value;
+        expected_values.push(Some(value));
+    }
+
+    let equals = EqualsOperatorEvaluator::new();
+    let mut used = vec![false; expected_values.len()];
+    for (index, actual_item) in actual.iter().enumerate() {
+        let mut candidates: Vec<usize> = if unordered {
+            (0..expected_values.len()).collect()
+        } else {
+            vec![index]
+        };
+        // Try specific expectations before wildcards
+        candidates.sort_by_key(|candidate| expected_values[*candidate].is_none());
+        let mut matched = None;
+        for candidate in candidates {
+            if used[candidate] {
+                continue;
+            }
+            let Some(expected_value) = expected_values[candidate].clone() else {
+                matched = Some(candidate);
+                break;
+            };
+            let result = equals
+                .evaluate(
+                    Collection::empty(),
+                    context,
+                    Collection::single(actual_item.clone()),
+                    expected_value,
+                )
+                .await
+                .map_err(|e| format!("index {index}: {e}"))?
+                .value;
+            if matches!(result.first(), Some(FhirPathValue::Boolean(true, ..))) {
+                matched = Some(candidate);
+                break;
+            }
+        }
+        match matched {
+            Some(candidate) => used[candidate] = true,
+            None => return Ok(false),
+        }
+    }
+    Ok(true)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn errors_are_checked_against_the_expected_text() {
+        let test_case: TestCase = serde_json::from_value(json!({
+            "name": "testUnknownFunction",
+            "expression": "Patient.nope()",
+            "expected": [],
+            "expectError": true,
+            "expectedError": "Unknown function"
+        }))
+        .unwrap();
+        assert!(test_case.check_error("Unknown function 'nope'").is_ok());
+        let wrong = test_case
+            .check_error("Failed to load input file patient.json")
+            .unwrap_err();
+        assert!(wrong.contains("Failed to load input file patient.json"));
+
+        let any_error = TestCase {
+            expected_error: None,
+            ..test_case
+        };
+        assert!(any_error.check_error("anything").is_ok());
+    }
+
+    #[test]
+    fn result_sizes_are_checked_against_the_expected_cardinality() {
+        let test_case: TestCase = serde_json::from_value(json!({
+            "name": "testFirst",
+            "expression": "Patient.name.first()",
+            "expected": [],
+            "expectedCardinality": "singleton"
+        }))
+        .unwrap();
+        assert_eq!(test_case.expected_cardinality, Some(Cardinality::Singleton));
+        assert!(test_case.check_cardinality(1).is_ok());
+        assert_eq!(
+            test_case.check_cardinality(2).unwrap_err(),
+            "Cardinality violation: expected exactly one item, got 2 items"
+        );
+        assert!(Cardinality::Optional.allows(0));
+        assert!(!Cardinality::Optional.allows(2));
+        assert!(Cardinality::Collection.allows(3));
+    }
+
+    #[test]
+    fn typed_items_pair_values_with_type_names() {
+        let typed = typed_items(
+            &json!([true, "true", 1]),
+            &["Boolean".to_string(), "String".to_string()],
+        );
+        assert_eq!(
+            typed,
+            json!([
+                {"type": "Boolean", "value": true},
+                {"type": "String", "value": "true"},
+                {"value": 1}
+            ])
+        );
+        assert_eq!(item_types(&typed), ["Boolean", "String"]);
+        assert_eq!(typed_items(&Value::Null, &[]), json!([]));
+    }
+
+    #[test]
+    fn report_values_keep_integers_as_numbers_and_decimals_as_strings() {
+        let actual = Collection::from_values(
+            [json!(3), json!(1.25), json!("1.25")]
+                .into_iter()
+                .map(json_to_fhirpath_value)
+                .collect(),
+        );
+        let typed = typed_result(&actual);
+        let values: Vec<&Value> = result_items(&typed)
+            .into_iter()
+            .map(|item| &item["value"])
+            .collect();
+        assert_eq!(values, [&json!(3), &json!("1.25"), &json!("1.25")]);
+        assert_eq!(item_types(&typed), collect_type_names(&actual));
+    }
+
+    #[test]
+    fn typed_inputs_become_parameter_values() {
+        let quantity = json!({"value": 5.5, "unit": "mg"});
+        assert_eq!(
+            typed_input_resource("Quantity", &quantity).unwrap()["parameter"][0]["valueQuantity"],
+            quantity
+        );
+        assert_eq!(
+            typed_input_resource("dateTime", &json!("2024-01-01")).unwrap()["parameter"][0]["valueDateTime"],
+            "2024-01-01"
+        );
+        assert!(typed_input_resource("", &json!(1)).is_err());
+        assert!(typed_input_resource("value[x]", &json!(1)).is_err());
+    }
+
+    #[test]
+    fn input_fingerprints_ignore_key_order_but_not_content() {
+        let patient = json!({"resourceType": "Patient", "active": true});
+        let reordered: Value =
+            serde_json::from_str(r#"{"active": true, "resourceType": "Patient"}"#).unwrap();
+        let fingerprint = input_fingerprint(&patient);
+        assert_eq!(fingerprint.len(), 16);
+        assert_eq!(fingerprint, input_fingerprint(&reordered));
+        assert_ne!(
+            fingerprint,
+            input_fingerprint(&json!({"resourceType": "Patient", "active": false}))
+        );
+    }
+
+    #[test]
+    fn expression_whitespace_is_normalized_outside_string_literals() {
+        assert_eq!(
+            normalize_expression(
+                "\n    Patient.name\n      .where(given = '  two  spaces\n ')\n  "
+            ),
+            "Patient.name\n.where(given = '  two  spaces\n ')"
+        );
+        assert_eq!(
+            normalize_expression("'a\\'  b'  +   `x  y`"),
+            "'a\\'  b' + `x  y`"
+        );
+    }
+
+    #[test]
+    fn quantities_compare_structurally_against_object_expectations() {
+        let quantity = json_to_fhirpath_value(json!({"value": 5, "unit": "mg"}));
+        let actual = Collection::single(quantity);
+
+        let expected = json!([{
+            "type": "Quantity",
+            "value": 5.0,
+            "unit": "mg",
+            "system": "http://unitsofmeasure.org",
+            "code": "mg"
+        }]);
+        assert!(compare_results(&expected, &actual, &[]));
+        assert_eq!(
+            result_to_json(&json!(["5 'mg'"]), &actual).unwrap(),
+            json!(["5 'mg'"])
+        );
+    }
+
+    #[test]
+    fn empty_expectations_only_match_empty_results() {
+        assert!(compare_results(&json!([]), &Collection::empty(), &[]));
+        assert!(compare_results(&Value::Null, &Collection::empty(), &[]));
+
+        let actual = Collection::single(FhirPathValue::string("x"));
+        assert!(!compare_results(&json!([]), &actual, &[]));
+        assert_eq!(
+            describe_mismatch(&json!([]), &actual, &[]).as_deref(),
+            Some("expected an empty collection, actual 1 unexpected item(s): \"x\"")
+        );
+    }
+
+    #[test]
+    fn expressions_may_be_a_chain_ending_in_the_checked_expression() {
+        let case: TestCase = serde_json::from_value(json!({
+            "name": "testChain",
+            "expression": ["defineVariable('x', 1)", "%x + 1"],
+            "expected": [2]
+        }))
+        .unwrap();
+        assert_eq!(case.expression.setup(), ["defineVariable('x', 1)"]);
+        assert_eq!(&*case.expression, "%x + 1");
+
+        let case: TestCase = serde_json::from_value(json!({
+            "name": "testSingle",
+            "expression": "1 + 1",
+            "expected": [2]
+        }))
+        .unwrap();
+        assert!(case.expression.setup().is_empty());
+        assert_eq!(case.expression.to_string(), "1 + 1");
+    }
+
+    #[test]
+    fn wildcards_match_any_single_item() {
+        let actual = Collection::from_values(vec![
+            FhirPathValue::string("generated-id"),
+            FhirPathValue::integer(3),
+        ]);
+        assert!(compare_results(&json!(["*", 3]), &actual, &[]));
+        assert!(compare_results(&json!(["*", "*"]), &actual, &[]));
+        assert!(!compare_results(&json!(["*"]), &actual, &[]));
+        assert!(!compare_results(&json!(["*", 4]), &actual, &[]));
+        assert!(compare_results_unordered(
+            &json!(["*", "generated-id"]),
+            &actual,
+            &[]
+        ));
+        assert!(!items_equal(&json!("*"), &Value::Null, None));
+    }
+
+    #[test]
+    fn wildcards_are_whole_items_only() {
+        let actual = Collection::single(json_to_fhirpath_value(json!({"id": "generated"})));
+        assert!(compare_results(&json!(["*"]), &actual, &[]));
+        assert!(!compare_results(&json!([{"id": "*"}]), &actual, &[]));
+        assert!(!json_values_equal(&json!("*"), &json!("generated")));
+        assert!(json_values_equal(&json!({"id": "*"}), &json!({"id": "*"})));
+    }
+
+    #[test]
+    fn empty_results_are_neither_true_nor_false() {
+        let empty = Collection::empty();
+        assert!(!compare_results(&json!([true]), &empty, &[]));
+        assert!(!compare_results(&json!([false]), &empty, &[]));
+        assert!(!compare_results(&json!(false), &empty, &[]));
+
+        let false_result = Collection::single(FhirPathValue::boolean(false));
+        assert!(!compare_results(&json!([]), &false_result, &[]));
+        assert!(!compare_results(&Value::Null, &false_result, &[]));
+        assert!(compare_results(&json!([false]), &false_result, &[]));
+    }
+
+    #[test]
+    fn unordered_comparison_matches_items_as_a_multiset() {
+        let actual = Collection::from_values(vec![
+            FhirPathValue::integer(3),
+            FhirPathValue::integer(1),
+            FhirPathValue::integer(1),
+        ]);
+        assert!(!compare_results(&json!([1, 1, 3]), &actual, &[]));
+        assert!(compare_results_unordered(&json!([1, 1, 3]), &actual, &[]));
+        assert!(!compare_results_unordered(&json!([1, 3, 3]), &actual, &[]));
+        assert!(!compare_results_unordered(&json!([1, 3]), &actual, &[]));
+        assert!(verify_output_types(&vec!["integer".to_string(); 3], &actual, true).is_ok());
+    }
+
+    #[test]
+    fn expected_items_become_literals_of_their_output_type() {
+        assert_eq!(
+            expected_literal(&json!("2015-02-04"), Some("date")).as_deref(),
+            Some("@2015-02-04")
+        );
+        assert_eq!(
+            expected_literal(&json!("T14:34:28"), Some("time")).as_deref(),
+            Some("@T14:34:28")
+        );
+        assert_eq!(
+            expected_literal(&json!("it's"), Some("string")).as_deref(),
+            Some("'it\\'s'")
+        );
+        assert_eq!(
+            expected_literal(&json!(1), Some("decimal")).as_deref(),
+            Some("1.0")
+        );
+        assert_eq!(
+            expected_literal(&json!({"value": 5, "unit": "mg"}), None).as_deref(),
+            Some("5 'mg'")
+        );
+        assert_eq!(expected_literal(&json!([1]), None), None);
+    }
+
+    #[test]
+    fn resource_variables_point_at_the_input() {
+        let bundle = FhirPathValue::resource(json!({
+            "resourceType": "Bundle",
+            "entry": [{"resource": {"resourceType": "Patient"}}]
+        }));
+        let names: Vec<String> = resource_variables(&bundle)
+            .into_iter()
+            .map(|(name, _)| name)
+            .collect();
+
+        assert_eq!(names, ["resource", "rootResource"]);
+        assert!(resource_variables(&FhirPathValue::string("x")).is_empty());
+    }
+
+    #[test]
+    fn mismatches_are_classified() {
+        assert_eq!(
+            classify_mismatch(&json!([true]), &json!(["true"]), &[]),
+            Some(MismatchKind::TypeMismatch)
+        );
+        assert_eq!(
+            classify_mismatch(&json!([1]), &json!([2]), &[]),
+            Some(MismatchKind::ValueMismatch)
+        );
+        assert_eq!(
+            classify_mismatch(&json!([1]), &json!([1, 2]), &[]),
+            Some(MismatchKind::CardinalityMismatch)
+        );
+        assert_eq!(classify_mismatch(&json!([1]), &json!([1.0]), &[]), None);
+    }
+
+    #[test]
+    fn ast_dump_drops_nested_locations() {
+        let mut tree = json!({
+            "PropertyAccess": {
+                "object": {"Identifier": {"name": "Patient", "location": {"offset": 0}}},
+                "property": "name",
+                "location": {"offset": 7}
+            }
+        });
+        strip_locations(&mut tree);
+        assert_eq!(
+            tree,
+            json!({
+                "PropertyAccess": {
+                    "object": {"Identifier": {"name": "Patient"}},
+                    "property": "name"
+                }
+            })
+        );
+    }
+
+    #[test]
+    fn fixed_now_is_read_as_an_instant() {
+        let case: TestCase = serde_json::from_value(json!({
+            "name": "testNow",
+            "expression": "now()",
+            "expected": [],
+            "fixedNow": "2015-02-07T13:28:17-05:00"
+        }))
+        .unwrap();
+
+        let now = parse_instant(case.fixed_now.as_deref().unwrap()).unwrap();
+        assert_eq!(now.to_rfc3339(), "2015-02-07T18:28:17+00:00");
+        assert!(parse_instant("yesterday").is_err());
+    }
+
+    #[test]
+    fn environment_variables_strip_percent_prefix() {
+        let case: TestCase = serde_json::from_value(json!({
+            "name": "testEnv",
+            "expression": "%greeting",
+            "expected": ["hello"],
+            "expectError": null,
+            "environment": {"%greeting": "hello", "limit": 3, "flag": true}
+        }))
+        .unwrap();
+
+        let vars = environment_variables(&case.environment);
+        let names: Vec<&str> = vars.iter().map(|(name, _)| name.as_str()).collect();
+        assert_eq!(names, ["greeting", "flag", "limit"]);
+        assert_eq!(vars[0].1, FhirPathValue::string("hello"));
+        assert_eq!(vars[1].1, FhirPathValue::boolean(true));
+        assert_eq!(vars[2].1, FhirPathValue::integer(3));
+    }
+
+    #[test]
+    fn mismatch_reports_first_differing_index() {
+        let message = describe_json_mismatch(&json!(["a", "b"]), &json!(["a", "c"]), &[]);
+        assert_eq!(
+            message.as_deref(),
+            Some(r#"index 1: expected "b", actual "c""#)
+        );
+    }
+
+    #[test]
+    fn mismatch_treats_order_as_significant() {
+        assert!(describe_json_mismatch(&json!([1, 2]), &json!([2, 1]), &[]).is_some());
+    }
+
+    #[test]
+    fn mismatch_reports_length_difference() {
+        let message = describe_json_mismatch(&json!([true]), &json!([true, false]), &[]);
+        assert_eq!(
+            message.as_deref(),
+            Some("expected 1 item(s), actual 2 item(s)")
+        );
+    }
+
+    #[test]
+    fn single_value_matches_singleton_collection() {
+        assert!(describe_json_mismatch(&json!(5), &json!([5]), &[]).is_none());
+        assert!(describe_json_mismatch(&Value::Null, &json!([]), &[]).is_none());
+    }
+
+    #[test]
+    fn numbers_compare_by_value() {
+        assert!(json_values_equal(&json!(185), &json!(185.0)));
+        assert!(json_values_equal(
+            &json!(185.0),
+            &serde_json::from_str::<Value>("1.85e2").unwrap()
+        ));
+        assert!(json_values_equal(&json!([1.50]), &json!([1.5])));
+        assert!(json_values_equal(
+            &serde_json::from_str::<Value>("185").unwrap(),
+            &serde_json::from_str::<Value>("1.85E+2").unwrap()
+        ));
+        assert!(!json_values_equal(&json!(185), &json!(185.1)));
+        assert!(!json_values_equal(
+            &json!(9_007_199_254_740_993_i64),
+            &json!(9_007_199_254_740_992.0)
+        ));
+        assert!(!json_values_equal(
+            &json!(18_446_744_073_709_551_615_u64),
+            &json!(18_446_744_073_709_551_614_u64)
+        ));
+        assert!(!json_values_equal(&json!("185"), &json!(185)));
+    }
+
+    #[test]
+    fn only_declared_temporals_compare_at_their_precision() {
+        let utc = json!("2015-02-07T13:28:17Z");
+        let offset = json!("2015-02-07T13:28:17+00:00");
+        assert!(items_equal(&utc, &offset, Some("dateTime")));
+        assert!(items_equal(&json!("1974"), &json!("@1974"), Some("date")));
+        assert!(!items_equal(&utc, &offset, Some("string")));
+        assert!(!items_equal(&utc, &offset, None));
+
+        let actual = Collection::single(FhirPathValue::string("2015-02-07T13:28:17+00:00"));
+        let string_type = ["string".to_string()];
+        assert!(!compare_results(&json!([utc]), &actual, &string_type));
+    }
+
+    #[test]
+    fn quantities_compare_across_units() {
+        let quantity = Some("Quantity");
+        assert!(items_equal(&json!("1 'm'"), &json!("100 'cm'"), quantity));
+        assert!(items_equal(
+            &json!({"value": 1500, "code": "mg", "system": "http://unitsofmeasure.org"}),
+            &json!({"value": 1.5, "unit": "g", "system": "http://unitsofmeasure.org", "code": "g"}),
+            quantity
+        ));
+        assert!(!items_equal(&json!("1 'm'"), &json!("1 'cm'"), quantity));
+        assert!(!items_equal(&json!("1 'm'"), &json!("1 'g'"), quantity));
+        assert!(!items_equal(&json!("1"), &json!("1.0"), quantity));
+
+        // Only declared quantities convert; strings that read as quantities do not
+        assert!(!items_equal(
+            &json!("1 'm'"),
+            &json!("100 'cm'"),
+            Some("string")
+        ));
+        assert!(!items_equal(&json!("1 'm'"), &json!("100 'cm'"), None));
+    }
+
+    #[test]
+    fn test_mode_parsing() {
+        assert_eq!(TestMode::parse(None), Ok(TestMode::Lenient));
+        assert_eq!(TestMode::parse(Some("strict")), Ok(TestMode::Strict));
+        assert_eq!(TestMode::parse(Some("Lenient")), Ok(TestMode::Lenient));
+        assert_eq!(
+            TestMode::parse(Some("pedantic")),
+            Err("pedantic".to_string())
+        );
+    }
+
+    #[test]
+    fn filter_matches_substring_or_glob() {
+        assert!(matches_filter("Patient.name", "testPatient.name.given"));
+        assert!(matches_filter("testBoolean*", "testBooleanLogicAnd1"));
+        assert!(matches_filter("test?ool*And?", "testBooleanLogicAnd1"));
+        assert!(!matches_filter("Boolean*", "testBooleanLogicAnd1"));
+        assert!(!matches_filter("quantity", "testBooleanLogicAnd1"));
     }
 }
@@ -0,0 +1,130 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Capture of `trace()` output per test case
+//!
+//! The engine holds a single trace provider, while test cases run concurrently. The
+//! provider here appends each emission to a buffer local to the tokio task that runs the
+//! test, so every test gets exactly its own traces. Emissions outside a capture are
+//! printed to stderr, as the CLI provider does.
+
+use octofhir_fhirpath::core::trace::{SharedTraceProvider, TraceProvider};
+use serde::Serialize;
+use std::cell::RefCell;
+use std::future::Future;
+use std::sync::Arc;
+
+tokio::task_local! {
+    static CAPTURED: RefCell<Vec<TraceEntry>>;
+}
+
+/// One value emitted by `trace()`
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct TraceEntry {
+    /// Name passed to `trace()`
+    pub label: String,
+    /// Position of the value in the traced collection
+    pub index: usize,
+    pub value: String,
+}
+
+struct CapturingTraceProvider;
+
+impl CapturingTraceProvider {
+    fn record(&self, label: &str, index: usize, value: &str) {
+        let entry = TraceEntry {
+            label: label.to_string(),
+            index,
+            value: value.to_string(),
+        };
+        if CAPTURED
+            .try_with(|captured| captured.borrow_mut().push(entry))
+            .is_err()
+        {
+            eprintln!("TRACE[{label}][{index}]: {value}");
+        }
+    }
+}
+
+impl TraceProvider for CapturingTraceProvider {
+    fn trace(&self, name: &str, index: usize, message: &str) {
+        self.record(name, index, message);
+    }
+
+    fn trace_simple(&self, name: &str, message: &str) {
+        self.record(name, 0, message);
+    }
+
+    fn collect_traces(&self) -> Vec<String> {
+        // Traces are handed out by `capture_traces`, per task
+        Vec::new()
+    }
+
+    fn clear_traces(&self) {}
+}
+
+/// Trace provider that feeds [`capture_traces`]
+pub fn create_capturing_provider() -> SharedTraceProvider {
+    Arc::new(CapturingTraceProvider)
+}
+
+/// Run a future, returning its output with the traces it emitted in order
+pub async fn capture_traces<F: Future>(future: F) -> (F::Output, Vec<TraceEntry>) {
+    CAPTURED
+        .scope(RefCell::new(Vec::new()), async {
+            let output = future.await;
+            let traces = CAPTURED.with(|captured| captured.take());
+            (output, traces)
+        })
+        .await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn each_capture_keeps_its_own_traces() {
+        let provider = create_capturing_provider();
+        let emit = |label: &'static str, values: &'static [&'static str]| {
+            let provider = provider.clone();
+            async move {
+                for (index, value) in values.iter().enumerate() {
+                    provider.trace(label, index, value);
+                    tokio::task::yield_now().await;
+                }
+            }
+        };
+
+        let ((), first) = capture_traces(emit("names", &["Peter", "Jim"])).await;
+        let ((), second) = capture_traces(emit("ids", &["1"])).await;
+        assert_eq!(
+            first,
+            [
+                TraceEntry {
+                    label: "names".to_string(),
+                    index: 0,
+                    value: "Peter".to_string()
+                },
+                TraceEntry {
+                    label: "names".to_string(),
+                    index: 1,
+                    value: "Jim".to_string()
+                },
+            ]
+        );
+        assert_eq!(second.len(), 1);
+        assert_eq!(second[0].label, "ids");
+    }
+}
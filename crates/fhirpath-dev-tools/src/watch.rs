@@ -0,0 +1,110 @@
+// Copyright 2024 OctoFHIR Team
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Polling file watcher for re-running tests on edits
+//!
+//! Files are watched by comparing their modification times on an interval, which needs no
+//! platform support. Editors often write a file several times in a row when saving, so a
+//! change is only reported once the files have stopped changing for a short while.
+
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime};
+
+/// Modification time of each watched file that exists
+pub type Snapshot = BTreeMap<PathBuf, SystemTime>;
+
+/// Take the modification times of the given files, leaving out files that are missing
+pub fn snapshot<'a>(paths: impl IntoIterator<Item = &'a PathBuf>) -> Snapshot {
+    paths
+        .into_iter()
+        .filter_map(|path| {
+            let modified = fs::metadata(path).and_then(|m| m.modified()).ok()?;
+            Some((path.clone(), modified))
+        })
+        .collect()
+}
+
+/// Files that were modified, created or removed between two snapshots
+pub fn changed_paths(before: &Snapshot, after: &Snapshot) -> BTreeSet<PathBuf> {
+    let modified = after
+        .iter()
+        .filter(|(path, modified)| before.get(*path) != Some(*modified))
+        .map(|(path, _)| path.clone());
+    let removed = before
+        .keys()
+        .filter(|path| !after.contains_key(*path))
+        .cloned();
+    modified.chain(removed).collect()
+}
+
+/// Block until any of the files changes and then stays unchanged for `settle`, returning
+/// every file that changed in the meantime
+pub fn wait_for_change(paths: &[PathBuf], poll: Duration, settle: Duration) -> BTreeSet<PathBuf> {
+    let baseline = snapshot(paths);
+    let mut current = baseline.clone();
+    loop {
+        std::thread::sleep(poll);
+        let next = snapshot(paths);
+        if next != current {
+            current = next;
+            continue;
+        }
+        if current == baseline {
+            continue;
+        }
+        // Something changed and the last poll saw no further writes; wait out the rest of
+        // the quiet period before reporting
+        std::thread::sleep(settle.saturating_sub(poll));
+        let next = snapshot(paths);
+        if next == current {
+            return changed_paths(&baseline, &current);
+        }
+        current = next;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn modified_added_and_removed_files_are_changes() {
+        let at = |secs| SystemTime::UNIX_EPOCH + Duration::from_secs(secs);
+        let before: Snapshot = [
+            (PathBuf::from("groups/a.json"), at(1)),
+            (PathBuf::from("groups/b.json"), at(1)),
+            (PathBuf::from("input/patient.json"), at(1)),
+        ]
+        .into();
+        let after: Snapshot = [
+            (PathBuf::from("groups/a.json"), at(2)),
+            (PathBuf::from("input/patient.json"), at(1)),
+            (PathBuf::from("input/observation.json"), at(3)),
+        ]
+        .into();
+
+        let changed: Vec<_> = changed_paths(&before, &after).into_iter().collect();
+        assert_eq!(
+            changed,
+            [
+                PathBuf::from("groups/a.json"),
+                PathBuf::from("groups/b.json"),
+                PathBuf::from("input/observation.json"),
+            ]
+        );
+        assert!(changed_paths(&after, &after).is_empty());
+    }
+}
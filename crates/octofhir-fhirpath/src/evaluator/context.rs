@@ -3,6 +3,7 @@
 //! This module provides a simplified evaluation context with proper variable scoping using
 //! parent chain pattern for variable scoping.
 
+use chrono::{DateTime, Utc};
 use papaya::HashMap as LockFreeHashMap;
 use std::sync::{Arc, LazyLock};
 
@@ -138,6 +139,8 @@ pub struct EvaluationContext {
     /// `None` on the common path, which keeps the lookup in the node evaluator
     /// down to a null check.
     hoist_scope: Option<Arc<HoistScope>>,
+    /// Instant seen by `now()`, `today()` and `timeOfDay()`; the system clock when unset
+    fixed_now: Option<DateTime<Utc>>,
 }
 
 /// Helper to create dynamic-only variables (terminologies, factory, server).
@@ -276,6 +279,7 @@ impl EvaluationContext {
             parent_context: None,
             root_resource,
             hoist_scope: None,
+            fixed_now: None,
         }
     }
 
@@ -342,6 +346,7 @@ impl EvaluationContext {
             parent_context: None, // Independent context has no parent
             root_resource: self.root_resource.clone(), // Share Arc reference
             hoist_scope: self.hoist_scope.clone(),
+            fixed_now: self.fixed_now,
         }
     }
 
@@ -355,6 +360,7 @@ impl EvaluationContext {
             parent_context: Some(Arc::new(self.clone())), // Arc avoids recursive deep clone
             root_resource: self.root_resource.clone(),   // Share Arc reference
             hoist_scope: self.hoist_scope.clone(),
+            fixed_now: self.fixed_now,
         }
     }
 
@@ -368,6 +374,7 @@ impl EvaluationContext {
             parent_context: Some(Arc::new(self.clone())), // Arc avoids recursive deep clone
             root_resource: self.root_resource.clone(),   // Share Arc reference
             hoist_scope: self.hoist_scope.clone(),
+            fixed_now: self.fixed_now,
         }
     }
 
@@ -501,6 +508,17 @@ impl EvaluationContext {
         self
     }
 
+    /// Return this context with `now()`, `today()` and `timeOfDay()` pinned to `now`.
+    pub fn with_fixed_now(mut self, now: DateTime<Utc>) -> Self {
+        self.fixed_now = Some(now);
+        self
+    }
+
+    /// The instant date/time functions evaluate against.
+    pub fn now(&self) -> DateTime<Utc> {
+        self.fixed_now.unwrap_or_else(Utc::now)
+    }
+
     /// The hoist scope in effect, if a lambda established one.
     pub fn hoist_scope(&self) -> Option<&Arc<HoistScope>> {
         self.hoist_scope.as_ref()
@@ -607,6 +625,7 @@ impl Clone for EvaluationContext {
             parent_context: self.parent_context.clone(),
             root_resource: self.root_resource.clone(),
             hoist_scope: self.hoist_scope.clone(),
+            fixed_now: self.fixed_now,
         }
     }
 }
@@ -906,11 +906,11 @@ impl FunctionRegistryBuilder {
         self.registry
             .register_lazy_function(DefineVariableFunctionEvaluator::create());
         self.registry
-            .register_pure_function(NowFunctionEvaluator::create());
+            .register_provider_pure_function(NowFunctionEvaluator::create());
         self.registry
-            .register_pure_function(TodayFunctionEvaluator::create());
+            .register_provider_pure_function(TodayFunctionEvaluator::create());
         self.registry
-            .register_pure_function(TimeOfDayFunctionEvaluator::create());
+            .register_provider_pure_function(TimeOfDayFunctionEvaluator::create());
         self.registry
             .register_lazy_function(TraceFunctionEvaluator::create());
 
@@ -7,11 +7,11 @@ use std::sync::Arc;
 
 use crate::core::temporal::PrecisionDateTime;
 use crate::core::{Collection, FhirPathError, FhirPathValue, Result};
-use crate::evaluator::EvaluationResult;
 use crate::evaluator::function_registry::{
     ArgumentEvaluationStrategy, EmptyPropagation, FunctionCategory, FunctionMetadata,
-    FunctionSignature, NullPropagationStrategy, PureFunctionEvaluator,
+    FunctionSignature, NullPropagationStrategy, ProviderPureFunctionEvaluator,
 };
+use crate::evaluator::{EvaluationContext, EvaluationResult};
 
 /// Now function evaluator
 pub struct NowFunctionEvaluator {
@@ -20,7 +20,7 @@ pub struct NowFunctionEvaluator {
 
 impl NowFunctionEvaluator {
     /// Create a new now function evaluator
-    pub fn create() -> Arc<dyn PureFunctionEvaluator> {
+    pub fn create() -> Arc<dyn ProviderPureFunctionEvaluator> {
         Arc::new(Self {
             metadata: FunctionMetadata {
                 name: "now".to_string(),
@@ -46,11 +46,12 @@ impl NowFunctionEvaluator {
 }
 
 #[async_trait::async_trait]
-impl PureFunctionEvaluator for NowFunctionEvaluator {
+impl ProviderPureFunctionEvaluator for NowFunctionEvaluator {
     async fn evaluate(
         &self,
         _input: Collection,
         _args: Vec<Collection>,
+        context: &EvaluationContext,
     ) -> Result<EvaluationResult> {
         if !_args.is_empty() {
             return Err(FhirPathError::evaluation_error(
@@ -59,8 +60,8 @@ impl PureFunctionEvaluator for NowFunctionEvaluator {
             ));
         }
 
-        // Get current system time as PrecisionDateTime
-        let now = chrono::Utc::now();
+        // Get current time as PrecisionDateTime (system clock unless the context pins it)
+        let now = context.now();
 
         // Convert to fixed offset (UTC)
         let fixed_offset_dt = now.with_timezone(&chrono::FixedOffset::east_opt(0).unwrap());
@@ -1,6 +1,7 @@
 //! Round function implementation
 //!
-//! The round function rounds the input to the nearest integer.
+//! The round function rounds the input to the nearest integer, with halves rounded
+//! away from zero as the specification requires.
 //! Syntax: number.round() or number.round(precision)
 
 use rust_decimal::prelude::*;
@@ -128,8 +129,9 @@ impl PureFunctionEvaluator for RoundFunctionEvaluator {
             }
         };
 
-        // Round to specified precision
-        let result_decimal = input_decimal.round_dp(precision);
+        // Round to specified precision; 2.5 becomes 3 and -2.5 becomes -3
+        let result_decimal =
+            input_decimal.round_dp_with_strategy(precision, RoundingStrategy::MidpointAwayFromZero);
 
         // For precision 0, return as integer if possible
         let result = if precision == 0 && result_decimal.fract() == Decimal::ZERO {
@@ -7,11 +7,11 @@ use std::sync::Arc;
 
 use crate::core::temporal::PrecisionTime;
 use crate::core::{Collection, FhirPathError, FhirPathValue, Result};
-use crate::evaluator::EvaluationResult;
 use crate::evaluator::function_registry::{
     ArgumentEvaluationStrategy, EmptyPropagation, FunctionCategory, FunctionMetadata,
-    FunctionSignature, NullPropagationStrategy, PureFunctionEvaluator,
+    FunctionSignature, NullPropagationStrategy, ProviderPureFunctionEvaluator,
 };
+use crate::evaluator::{EvaluationContext, EvaluationResult};
 
 /// TimeOfDay function evaluator
 pub struct TimeOfDayFunctionEvaluator {
@@ -20,7 +20,7 @@ pub struct TimeOfDayFunctionEvaluator {
 
 impl TimeOfDayFunctionEvaluator {
     /// Create a new timeOfDay function evaluator
-    pub fn create() -> Arc<dyn PureFunctionEvaluator> {
+    pub fn create() -> Arc<dyn ProviderPureFunctionEvaluator> {
         Arc::new(Self {
             metadata: FunctionMetadata {
                 name: "timeOfDay".to_string(),
@@ -46,11 +46,12 @@ impl TimeOfDayFunctionEvaluator {
 }
 
 #[async_trait::async_trait]
-impl PureFunctionEvaluator for TimeOfDayFunctionEvaluator {
+impl ProviderPureFunctionEvaluator for TimeOfDayFunctionEvaluator {
     async fn evaluate(
         &self,
         _input: Collection,
         _args: Vec<Collection>,
+        context: &EvaluationContext,
     ) -> Result<EvaluationResult> {
         if !_args.is_empty() {
             return Err(FhirPathError::evaluation_error(
@@ -59,8 +60,8 @@ impl PureFunctionEvaluator for TimeOfDayFunctionEvaluator {
             ));
         }
 
-        // Get current system time
-        let now = chrono::Utc::now();
+        // Get current time (system clock unless the context pins it)
+        let now = context.now();
         let current_time = now.time();
 
         // Create a PrecisionTime from the current time with second precision
@@ -7,11 +7,11 @@ use std::sync::Arc;
 
 use crate::core::temporal::PrecisionDate;
 use crate::core::{Collection, FhirPathError, FhirPathValue, Result};
-use crate::evaluator::EvaluationResult;
 use crate::evaluator::function_registry::{
     ArgumentEvaluationStrategy, EmptyPropagation, FunctionCategory, FunctionMetadata,
-    FunctionSignature, NullPropagationStrategy, PureFunctionEvaluator,
+    FunctionSignature, NullPropagationStrategy, ProviderPureFunctionEvaluator,
 };
+use crate::evaluator::{EvaluationContext, EvaluationResult};
 
 /// Today function evaluator
 pub struct TodayFunctionEvaluator {
@@ -20,7 +20,7 @@ pub struct TodayFunctionEvaluator {
 
 impl TodayFunctionEvaluator {
     /// Create a new today function evaluator
-    pub fn create() -> Arc<dyn PureFunctionEvaluator> {
+    pub fn create() -> Arc<dyn ProviderPureFunctionEvaluator> {
         Arc::new(Self {
             metadata: FunctionMetadata {
                 name: "today".to_string(),
@@ -46,11 +46,12 @@ impl TodayFunctionEvaluator {
 }
 
 #[async_trait::async_trait]
-impl PureFunctionEvaluator for TodayFunctionEvaluator {
+impl ProviderPureFunctionEvaluator for TodayFunctionEvaluator {
     async fn evaluate(
         &self,
         _input: Collection,
         _args: Vec<Collection>,
+        context: &EvaluationContext,
     ) -> Result<EvaluationResult> {
         if !_args.is_empty() {
             return Err(FhirPathError::evaluation_error(
@@ -59,8 +60,8 @@ impl PureFunctionEvaluator for TodayFunctionEvaluator {
             ));
         }
 
-        // Get current system time
-        let now = chrono::Utc::now();
+        // Get current time (system clock unless the context pins it)
+        let now = context.now();
 
         // Create a PrecisionDate from the current date with day precision
         use crate::core::TemporalPrecision;
@@ -0,0 +1,40 @@
+use std::sync::Arc;
+
+use chrono::{TimeZone, Utc};
+use octofhir_fhir_model::EmptyModelProvider;
+use octofhir_fhirpath::{
+    Collection, EvaluationContext, FhirPathEngine, FhirPathValue, create_function_registry,
+};
+
+async fn evaluate_pinned(expression: &str) -> bool {
+    let model_provider = Arc::new(EmptyModelProvider);
+    let now = Utc.with_ymd_and_hms(2024, 3, 1, 10, 15, 30).unwrap();
+    let context =
+        EvaluationContext::new(Collection::empty(), model_provider.clone(), None, None, None)
+            .with_fixed_now(now);
+
+    let engine = FhirPathEngine::new(Arc::new(create_function_registry()), model_provider)
+        .await
+        .expect("engine creation");
+
+    let result = engine
+        .evaluate(expression, &context)
+        .await
+        .expect("expression evaluation");
+
+    match result.value.first() {
+        Some(FhirPathValue::Boolean(value, _, _)) => *value,
+        other => panic!("expected boolean result, got {other:?}"),
+    }
+}
+
+#[tokio::test]
+async fn now_honours_the_pinned_instant() {
+    assert!(evaluate_pinned("now().toString().startsWith('2024-03-01T10:15:30')").await);
+}
+
+#[tokio::test]
+async fn today_and_time_of_day_honour_the_pinned_instant() {
+    assert!(evaluate_pinned("today() = @2024-03-01").await);
+    assert!(evaluate_pinned("timeOfDay() = @T10:15:30").await);
+}